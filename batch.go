@@ -0,0 +1,116 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"sync"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/taskqueue"
+
+	"golang.org/x/net/context"
+)
+
+// Task batching --------------------------------------------------------------
+
+// maxTaskBatch is the number of tasks taskqueue.AddMulti accepts per call.
+const maxTaskBatch = 100
+
+// TaskBatch collects the AsyncWrite tasks of the saves made with a context
+// returned by WithTaskBatch, so that they are added to the queue together by
+// Flush rather than one by one. Middleware uses one for every request if
+// the store's BatchTasks is set.
+type TaskBatch struct {
+	mu      sync.Mutex
+	tasks   []batchedTask
+	flushed bool
+}
+
+// batchedTask is a task collected by a TaskBatch, along with the write it
+// carries, which Flush makes directly if the task cannot be added.
+type batchedTask struct {
+	task  *taskqueue.Task
+	write func(c context.Context) error
+}
+
+// taskBatchKey is the context key set by WithTaskBatch.
+type taskBatchKey struct{}
+
+// WithTaskBatch returns a copy of c that makes the stores collect their
+// AsyncWrite tasks in the returned batch instead of adding them to the queue:
+//
+//	c, batch := gaesessions.WithTaskBatch(r.Context())
+//	r = r.WithContext(c)
+//	...
+//	err := batch.Flush(c)
+//
+// Save returns before the writes are enqueued, so its errors are reported
+// by Flush instead, and the writes are lost unless Flush is called.
+func WithTaskBatch(c context.Context) (context.Context, *TaskBatch) {
+	b := new(TaskBatch)
+	return context.WithValue(c, taskBatchKey{}, b), b
+}
+
+// batchTask adds t, which makes the write done by write, to the batch of c,
+// if any, and reports whether it did. Tasks are no longer collected once the
+// batch has been flushed.
+func batchTask(c context.Context, t *taskqueue.Task, write func(c context.Context) error) bool {
+	b, ok := c.Value(taskBatchKey{}).(*TaskBatch)
+	if !ok {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.flushed {
+		return false
+	}
+	b.tasks = append(b.tasks, batchedTask{t, write})
+	return true
+}
+
+// Flush adds the collected tasks to the default queue, up to 100 per call.
+// Tasks of later saves are added to the queue directly. The writes of tasks
+// that cannot be added are made directly, as an unbatched save would, except
+// for tasks whose name is taken, which fail with
+// taskqueue.ErrTaskAlreadyAdded. Flush returns the first error met, after
+// handling every task.
+func (b *TaskBatch) Flush(c context.Context) error {
+	b.mu.Lock()
+	batched := b.tasks
+	b.tasks, b.flushed = nil, true
+	b.mu.Unlock()
+	var firstErr error
+	for len(batched) > 0 {
+		n := len(batched)
+		if n > maxTaskBatch {
+			n = maxTaskBatch
+		}
+		tasks := make([]*taskqueue.Task, n)
+		for i := range tasks {
+			tasks[i] = batched[i].task
+		}
+		addOps(c, opTask, n)
+		_, err := taskqueue.AddMulti(c, tasks, "")
+		merr, _ := err.(appengine.MultiError)
+		for i, bt := range batched[:n] {
+			terr := err
+			if merr != nil {
+				terr = merr[i]
+			}
+			if terr == nil {
+				continue
+			}
+			if terr != taskqueue.ErrTaskAlreadyAdded && c.Err() == nil {
+				logger(c).Warningf(c, "gaesessions: enqueueing batched write, writing directly: %v", terr)
+				terr = bt.write(c)
+			}
+			if terr != nil && firstErr == nil {
+				firstErr = contextErr(c, terr)
+			}
+		}
+		batched = batched[n:]
+	}
+	return firstErr
+}
@@ -0,0 +1,56 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"google.golang.org/appengine/memcache"
+
+	"golang.org/x/net/context"
+)
+
+// Cache ----------------------------------------------------------------------
+
+// Cache is the part of the memcache API that MemcacheStore uses, so that
+// another cache, e.g. an in-process map in tests, can take its place.
+// Implementations must report missing keys with memcache.ErrCacheMiss, and
+// failures of individual keys in DeleteMulti with an appengine.MultiError.
+// Add must fail with memcache.ErrNotStored if the key is in use.
+// CompareAndSwap is only given items returned by Get, and must fail with
+// memcache.ErrCASConflict if the item changed since.
+type Cache interface {
+	Get(c context.Context, key string) (*memcache.Item, error)
+	Set(c context.Context, item *memcache.Item) error
+	Add(c context.Context, item *memcache.Item) error
+	CompareAndSwap(c context.Context, item *memcache.Item) error
+	Delete(c context.Context, key string) error
+	DeleteMulti(c context.Context, keys []string) error
+}
+
+// appEngineCache is the Cache backed by App Engine memcache.
+type appEngineCache struct{}
+
+func (appEngineCache) Get(c context.Context, key string) (*memcache.Item, error) {
+	return memcache.Get(c, key)
+}
+
+func (appEngineCache) Set(c context.Context, item *memcache.Item) error {
+	return memcache.Set(c, item)
+}
+
+func (appEngineCache) Add(c context.Context, item *memcache.Item) error {
+	return memcache.Add(c, item)
+}
+
+func (appEngineCache) CompareAndSwap(c context.Context, item *memcache.Item) error {
+	return memcache.CompareAndSwap(c, item)
+}
+
+func (appEngineCache) Delete(c context.Context, key string) error {
+	return memcache.Delete(c, key)
+}
+
+func (appEngineCache) DeleteMulti(c context.Context, keys []string) error {
+	return memcache.DeleteMulti(c, keys)
+}
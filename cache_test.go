@@ -0,0 +1,106 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"sync"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/memcache"
+
+	"golang.org/x/net/context"
+)
+
+// mapCache is a Cache kept in process memory, standing in for memcache in
+// tests. Expirations are ignored.
+type mapCache struct {
+	mu    sync.Mutex
+	items map[string]memcache.Item
+	// got records the value of each item returned by Get, for
+	// CompareAndSwap.
+	got map[*memcache.Item][]byte
+}
+
+func newMapCache() *mapCache {
+	return &mapCache{
+		items: make(map[string]memcache.Item),
+		got:   make(map[*memcache.Item][]byte),
+	}
+}
+
+func (m *mapCache) Get(c context.Context, key string) (*memcache.Item, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	item, ok := m.items[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+	m.got[&item] = item.Value
+	return &item, nil
+}
+
+func (m *mapCache) Set(c context.Context, item *memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.items[item.Key] = *item
+	return nil
+}
+
+func (m *mapCache) Add(c context.Context, item *memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+	m.items[item.Key] = *item
+	return nil
+}
+
+func (m *mapCache) CompareAndSwap(c context.Context, item *memcache.Item) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old, ok := m.items[item.Key]
+	if !ok {
+		return memcache.ErrNotStored
+	}
+	if string(old.Value) != string(m.got[item]) {
+		return memcache.ErrCASConflict
+	}
+	m.items[item.Key] = *item
+	return nil
+}
+
+func (m *mapCache) Delete(c context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.items[key]; !ok {
+		return memcache.ErrCacheMiss
+	}
+	delete(m.items, key)
+	return nil
+}
+
+func (m *mapCache) DeleteMulti(c context.Context, keys []string) error {
+	errs := make(appengine.MultiError, len(keys))
+	failed := false
+	for i, key := range keys {
+		if errs[i] = m.Delete(c, key); errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+// discardLogger is a Logger dropping every line, for stores used outside
+// App Engine.
+type discardLogger struct{}
+
+func (discardLogger) Debugf(c context.Context, format string, args ...interface{})   {}
+func (discardLogger) Infof(c context.Context, format string, args ...interface{})    {}
+func (discardLogger) Warningf(c context.Context, format string, args ...interface{}) {}
+func (discardLogger) Errorf(c context.Context, format string, args ...interface{})   {}
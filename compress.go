@@ -0,0 +1,173 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression ----------------------------------------------------------------
+
+// A compressed blob is stored as
+//
+//	formatCompressed | algorithm (1 byte) | dictionary ID (4 bytes, big endian) | payload
+//
+// where payload is the compressed form of a format-tagged serialized blob.
+// A dictionary ID of 0 means no dictionary was used.
+const (
+	formatCompressed byte = 0x80
+
+	compressedHeaderLen = 6
+)
+
+// Algorithm tags for the built-in compressors.
+const (
+	AlgorithmZstd byte = 1
+)
+
+// Compressor compresses serialized session values before they are stored.
+type Compressor interface {
+	// Algorithm returns the tag stored with every blob the compressor
+	// produces.
+	Algorithm() byte
+	// Compress compresses src and returns the ID of the dictionary used, or
+	// 0 if none was used.
+	Compress(src []byte) (dictID uint32, dst []byte, err error)
+	// Decompress decompresses src, which was compressed using the
+	// dictionary with the given ID.
+	Decompress(src []byte, dictID uint32) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[byte]Compressor{}
+)
+
+// RegisterCompressor makes a compressor available for loading blobs tagged
+// with its algorithm. A store can always load blobs written by its own
+// Compressor; registering is only needed to read blobs written with a
+// compressor the store no longer uses. It panics if the algorithm is 0, which
+// StoreConfig uses for no compression, or if a compressor with the same
+// algorithm is already registered.
+func RegisterCompressor(c Compressor) {
+	algorithm := c.Algorithm()
+	if algorithm == 0 {
+		panic("gaesessions: RegisterCompressor called for algorithm 0")
+	}
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	if _, dup := compressors[algorithm]; dup {
+		panic(fmt.Sprintf("gaesessions: RegisterCompressor called twice for algorithm %d", algorithm))
+	}
+	compressors[algorithm] = c
+}
+
+// compress wraps a serialized blob in a compressed envelope using c.
+func compress(c Compressor, src []byte) ([]byte, error) {
+	dictID, b, err := c.Compress(src)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, compressedHeaderLen, compressedHeaderLen+len(b))
+	dst[0] = formatCompressed
+	dst[1] = c.Algorithm()
+	binary.BigEndian.PutUint32(dst[2:], dictID)
+	return append(dst, b...), nil
+}
+
+// decompress unwraps a compressed envelope and returns the serialized blob
+// inside it. It uses c if it matches the blob's algorithm, and a registered
+// compressor otherwise.
+func decompress(c Compressor, src []byte) ([]byte, error) {
+	if len(src) < compressedHeaderLen {
+		return nil, errors.New("gaesessions: truncated compressed blob")
+	}
+	ok := c != nil && c.Algorithm() == src[1]
+	if !ok {
+		compressorsMu.RLock()
+		c, ok = compressors[src[1]]
+		compressorsMu.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("gaesessions: unknown compression algorithm %d", src[1])
+	}
+	return c.Decompress(src[compressedHeaderLen:], binary.BigEndian.Uint32(src[2:]))
+}
+
+// ZstdCompressor compresses session values with zstd, optionally using
+// dictionaries. Dictionaries pay off when many sessions share structure,
+// e.g. the same keys and similar values.
+type ZstdCompressor struct {
+	enc    *zstd.Encoder
+	dec    *zstd.Decoder
+	dictID uint32
+	dicts  map[uint32]bool
+}
+
+// NewZstdCompressor returns a ZstdCompressor. dict, if not nil, is the zstd
+// dictionary (as produced by "zstd --train") used to compress new sessions.
+// oldDicts are additional dictionaries that are only used to decompress
+// sessions written with them, which allows dictionaries to be replaced.
+func NewZstdCompressor(dict []byte, oldDicts ...[]byte) (*ZstdCompressor, error) {
+	z := &ZstdCompressor{dicts: make(map[uint32]bool)}
+	var encOpts []zstd.EOption
+	var decDicts [][]byte
+	if dict != nil {
+		id, err := zstdDictID(dict)
+		if err != nil {
+			return nil, err
+		}
+		z.dictID = id
+		z.dicts[id] = true
+		encOpts = append(encOpts, zstd.WithEncoderDict(dict))
+		decDicts = append(decDicts, dict)
+	}
+	for _, d := range oldDicts {
+		id, err := zstdDictID(d)
+		if err != nil {
+			return nil, err
+		}
+		z.dicts[id] = true
+		decDicts = append(decDicts, d)
+	}
+	var err error
+	if z.enc, err = zstd.NewWriter(nil, encOpts...); err != nil {
+		return nil, err
+	}
+	if z.dec, err = zstd.NewReader(nil, zstd.WithDecoderDicts(decDicts...)); err != nil {
+		return nil, err
+	}
+	return z, nil
+}
+
+// zstdDictID returns the ID stored in the header of a zstd dictionary.
+func zstdDictID(dict []byte) (uint32, error) {
+	if len(dict) < 8 || binary.LittleEndian.Uint32(dict) != 0xEC30A437 {
+		return 0, errors.New("gaesessions: invalid zstd dictionary")
+	}
+	return binary.LittleEndian.Uint32(dict[4:]), nil
+}
+
+// Algorithm returns AlgorithmZstd.
+func (z *ZstdCompressor) Algorithm() byte { return AlgorithmZstd }
+
+// Compress compresses src with the compressor's dictionary, if any.
+func (z *ZstdCompressor) Compress(src []byte) (uint32, []byte, error) {
+	return z.dictID, z.enc.EncodeAll(src, nil), nil
+}
+
+// Decompress decompresses src, which must have been compressed with a
+// dictionary known to the compressor if dictID is not 0.
+func (z *ZstdCompressor) Decompress(src []byte, dictID uint32) ([]byte, error) {
+	if dictID != 0 && !z.dicts[dictID] {
+		return nil, fmt.Errorf("gaesessions: unknown zstd dictionary %d", dictID)
+	}
+	return z.dec.DecodeAll(src, nil)
+}
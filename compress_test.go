@@ -0,0 +1,152 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+)
+
+// sampleSessions returns n serialized sessions shaped like those of a
+// telemetry-heavy app: the same keys in every session, with values that
+// differ from session to session.
+func sampleSessions(t testing.TB, n int) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	pages := []string{"/", "/search", "/settings", "/checkout", "/articles/latest"}
+	samples := make([][]byte, n)
+	for i := range samples {
+		values := map[interface{}]interface{}{
+			"user_id":    fmt.Sprintf("user-%08d", rng.Intn(1e8)),
+			"locale":     []string{"en-US", "en-GB", "de-DE", "fr-FR"}[rng.Intn(4)],
+			"logged_in":  rng.Intn(2) == 1,
+			"visits":     rng.Intn(1000),
+			"last_seen":  time.Unix(1.7e9+rng.Int63n(1e7), 0).UTC().Format(time.RFC3339),
+			"last_page":  pages[rng.Intn(len(pages))],
+			"experiment": fmt.Sprintf("exp-%d:variant-%c", rng.Intn(20), 'a'+rng.Intn(3)),
+			"csrf_token": fmt.Sprintf("%016x%016x", rng.Uint64(), rng.Uint64()),
+		}
+		b, err := serialize(GobSerializer{}, values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples[i] = b
+	}
+	return samples
+}
+
+// sampleDict builds a zstd dictionary with the given ID from samples.
+func sampleDict(t testing.TB, samples [][]byte, id uint32) []byte {
+	d, err := dict.BuildZstdDict(samples, dict.Options{
+		MaxDictSize: 4096,
+		HashBytes:   6,
+		ZstdDictID:  id,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestZstdOldDictionary(t *testing.T) {
+	samples := sampleSessions(t, 200)
+	oldDict, newDict := sampleDict(t, samples[:100], 1001), sampleDict(t, samples[100:], 1002)
+	old, err := NewZstdCompressor(oldDict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := compress(old, samples[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := NewZstdCompressor(newDict, oldDict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decompress(rotated, blob)
+	if err != nil {
+		t.Fatalf("decompress with the old dictionary: %v", err)
+	}
+	if !bytes.Equal(got, samples[0]) {
+		t.Fatal("decompress with the old dictionary returned different bytes")
+	}
+
+	fresh, err := NewZstdCompressor(newDict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decompress(fresh, blob); err == nil {
+		t.Fatal("decompress succeeded without the dictionary the blob was written with")
+	}
+}
+
+// BenchmarkZstd compresses the sample sessions with and without a
+// dictionary trained on other sessions, reporting the stored size relative
+// to the serialized size.
+func BenchmarkZstd(b *testing.B) {
+	samples := sampleSessions(b, 1200)
+	train, test := samples[:1000], samples[1000:]
+	plain, err := NewZstdCompressor(nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	withDict, err := NewZstdCompressor(sampleDict(b, train, 1001))
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, bc := range []struct {
+		name string
+		c    Compressor
+	}{
+		{"NoDict", plain},
+		{"Dict", withDict},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			in, out := 0, 0
+			for i := 0; i < b.N; i++ {
+				src := test[i%len(test)]
+				blob, err := compress(bc.c, src)
+				if err != nil {
+					b.Fatal(err)
+				}
+				in += len(src)
+				out += len(blob)
+			}
+			b.ReportMetric(float64(out)/float64(in), "ratio")
+			b.ReportMetric(float64(out)/float64(b.N), "bytes/session")
+		})
+	}
+}
+
+// nopCompressor stores blobs as they are under its algorithm.
+type nopCompressor byte
+
+func (c nopCompressor) Algorithm() byte { return byte(c) }
+
+func (nopCompressor) Compress(src []byte) (uint32, []byte, error) { return 0, src, nil }
+
+func (nopCompressor) Decompress(src []byte, dictID uint32) ([]byte, error) { return src, nil }
+
+func TestRegisterCompressorAlgorithms(t *testing.T) {
+	if !panics(func() { RegisterCompressor(nopCompressor(0)) }) {
+		t.Error("RegisterCompressor accepted algorithm 0")
+	}
+	t.Cleanup(func() {
+		compressorsMu.Lock()
+		delete(compressors, 200)
+		compressorsMu.Unlock()
+	})
+	if panics(func() { RegisterCompressor(nopCompressor(200)) }) {
+		t.Fatal("RegisterCompressor rejected algorithm 200")
+	}
+	if !panics(func() { RegisterCompressor(nopCompressor(200)) }) {
+		t.Error("RegisterCompressor replaced the compressor registered for algorithm 200")
+	}
+}
@@ -0,0 +1,20 @@
+module github.com/news-ai/gaesessions
+
+go 1.20
+
+require (
+	github.com/gorilla/securecookie v1.1.2
+	github.com/gorilla/sessions v1.2.2
+	github.com/klauspost/compress v1.17.9
+	github.com/qedus/nds v1.0.0
+	go.opencensus.io v0.24.0
+	golang.org/x/crypto v0.0.0-20210921155107-089bfa567519
+	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
+	google.golang.org/appengine v1.6.8
+)
+
+require (
+	github.com/golang/groupcache v0.0.0-20200121045136-8c9f03a8e57e // indirect
+	github.com/golang/protobuf v1.5.2 // indirect
+	google.golang.org/protobuf v1.26.0 // indirect
+)
@@ -0,0 +1,52 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/gorilla/securecookie"
+)
+
+// Key derivation -------------------------------------------------------------
+
+// DeriveKeyPairs derives n generations of hash and block keys from a single
+// master secret, newest generation first, in the form expected by
+// NewDatastoreStore, NewMemcacheStore and RotateKeys.
+//
+// The keys of generation g (1 <= g <= n) are the first 32 bytes of
+// HKDF-SHA256 with masterSecret as the secret, no salt, and the info strings
+// "gaesessions/v<g>/hash" and "gaesessions/v<g>/block" respectively, so any
+// instance configured with the same secret derives the same keys. To rotate
+// keys, increase n: cookies are then encoded with the new generation while
+// cookies encoded with older generations still decode.
+func DeriveKeyPairs(masterSecret []byte, n int) [][]byte {
+	keyPairs := make([][]byte, 0, 2*n)
+	for g := n; g >= 1; g-- {
+		keyPairs = append(keyPairs,
+			deriveKey(masterSecret, fmt.Sprintf("gaesessions/v%d/hash", g)),
+			deriveKey(masterSecret, fmt.Sprintf("gaesessions/v%d/block", g)))
+	}
+	return keyPairs
+}
+
+// DeriveCodecs returns codecs for the keys derived by DeriveKeyPairs.
+func DeriveCodecs(masterSecret []byte, n int) []securecookie.Codec {
+	return securecookie.CodecsFromPairs(DeriveKeyPairs(masterSecret, n)...)
+}
+
+// deriveKey derives a 32-byte key from secret for the given purpose.
+func deriveKey(secret []byte, info string) []byte {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, secret, nil, []byte(info)), key); err != nil {
+		// HKDF-SHA256 can produce up to 8160 bytes; 32 never fails.
+		panic(err)
+	}
+	return key
+}
@@ -0,0 +1,86 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/sessions"
+)
+
+// LazySession ----------------------------------------------------------------
+
+// LazySession defers loading a session until its values are first used, so
+// that middleware can attach a session to every request without a datastore
+// or memcache read on the paths that never touch it. Like the request it
+// belongs to, it must not be used by several goroutines at once.
+type LazySession struct {
+	r     *http.Request
+	store sessions.Store
+	name  string
+
+	once    sync.Once
+	session *sessions.Session
+	err     error
+}
+
+// NewLazySession returns a LazySession for the session with the given name
+// in store. Nothing is read until the session is used.
+func NewLazySession(r *http.Request, store sessions.Store, name string) *LazySession {
+	return &LazySession{r: r, store: store, name: name}
+}
+
+// Session loads the session on the first call, through the request's
+// registry like store.Get, and returns it.
+func (l *LazySession) Session() (*sessions.Session, error) {
+	l.once.Do(func() {
+		l.session, l.err = sessions.GetRegistry(l.r).Get(l.store, l.name)
+	})
+	return l.session, l.err
+}
+
+// Loaded reports whether the session has been loaded successfully.
+func (l *LazySession) Loaded() bool {
+	return l.session != nil && l.err == nil
+}
+
+// Get returns the value stored under key, loading the session if needed.
+func (l *LazySession) Get(key interface{}) (interface{}, error) {
+	session, err := l.Session()
+	if err != nil {
+		return nil, err
+	}
+	return session.Values[key], nil
+}
+
+// Set stores value under key, loading the session if needed.
+func (l *LazySession) Set(key, value interface{}) error {
+	session, err := l.Session()
+	if err != nil {
+		return err
+	}
+	session.Values[key] = value
+	return nil
+}
+
+// Delete removes the value stored under key, loading the session if needed.
+func (l *LazySession) Delete(key interface{}) error {
+	session, err := l.Session()
+	if err != nil {
+		return err
+	}
+	delete(session.Values, key)
+	return nil
+}
+
+// Save saves the session if it was loaded successfully, and does nothing
+// otherwise, so that a failed load cannot overwrite the stored session.
+func (l *LazySession) Save(w http.ResponseWriter) error {
+	if !l.Loaded() {
+		return nil
+	}
+	return l.session.Save(l.r, w)
+}
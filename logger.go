@@ -0,0 +1,67 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"google.golang.org/appengine/log"
+
+	"golang.org/x/net/context"
+)
+
+// Logging --------------------------------------------------------------------
+
+// Logger receives the log lines of the stores. Each call gets the context
+// of the operation that logs, so an implementation can add e.g. a request
+// correlation ID stored in it.
+type Logger interface {
+	Debugf(c context.Context, format string, args ...interface{})
+	Infof(c context.Context, format string, args ...interface{})
+	Warningf(c context.Context, format string, args ...interface{})
+	Errorf(c context.Context, format string, args ...interface{})
+}
+
+// loggerKey is the context key set by WithLogger.
+type loggerKey struct{}
+
+// WithLogger returns a copy of c that makes the stores log through l instead
+// of the App Engine log package:
+//
+//	r = r.WithContext(gaesessions.WithLogger(r.Context(), logger))
+//	session, err := store.Get(r, "session")
+//
+// The App Engine log package panics when given a context that does not come
+// from an App Engine request, so code calling the stores with any other
+// context, e.g. with a Cache backed by another service, must set a Logger.
+func WithLogger(c context.Context, l Logger) context.Context {
+	return context.WithValue(c, loggerKey{}, l)
+}
+
+// logger returns the Logger set on c by WithLogger, or one logging through
+// the App Engine log package.
+func logger(c context.Context) Logger {
+	if l, ok := c.Value(loggerKey{}).(Logger); ok {
+		return l
+	}
+	return appEngineLogger{}
+}
+
+// appEngineLogger is the Logger backed by the App Engine log package.
+type appEngineLogger struct{}
+
+func (appEngineLogger) Debugf(c context.Context, format string, args ...interface{}) {
+	log.Debugf(c, format, args...)
+}
+
+func (appEngineLogger) Infof(c context.Context, format string, args ...interface{}) {
+	log.Infof(c, format, args...)
+}
+
+func (appEngineLogger) Warningf(c context.Context, format string, args ...interface{}) {
+	log.Warningf(c, format, args...)
+}
+
+func (appEngineLogger) Errorf(c context.Context, format string, args ...interface{}) {
+	log.Errorf(c, format, args...)
+}
@@ -0,0 +1,272 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// MapStore -------------------------------------------------------------------
+
+// errNoSuchMapSession is returned when a session is missing from a MapStore.
+var errNoSuchMapSession = errors.New("gaesessions: no such session in map store")
+
+// NewMapStore returns a new MapStore.
+//
+// MapStore keeps sessions in process memory and does not talk to any App
+// Engine service, which makes it suitable for local development and tests.
+// Sessions are not shared between instances and are lost on restart.
+//
+// See NewCookieStore() for a description of the other parameters.
+func NewMapStore(nonPersistentSessionDuration time.Duration, keyPairs ...[]byte) *MapStore {
+	return &MapStore{
+		Codecs:                       securecookie.CodecsFromPairs(keyPairs...),
+		Options:                      defaultOptions(),
+		nonPersistentSessionDuration: nonPersistentSessionDuration,
+		entries:                      make(map[string]Session),
+	}
+}
+
+// MapStore stores sessions in an in-memory map.
+type MapStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options // default configuration
+	// Domain, if set, is copied into the options of every new session.
+	Domain string
+	// Path, if set, is copied into the options of every new session.
+	// Otherwise the path from Options is used, which defaults to "/".
+	Path string
+	// MaxCookieLength is the maximum length of the session cookie's name and
+	// value. Save fails with ErrCookieTooLong rather than set a longer
+	// cookie, which browsers would drop. If 0, 4096 is used; if negative, the
+	// length is not checked.
+	MaxCookieLength int
+	// CookieNameFunc, if set, returns the name of the cookie carrying the
+	// session with the given name, e.g. to use a fixed "__Host-" prefixed
+	// name whatever the session is called in code.
+	CookieNameFunc func(sessionName string) string
+	// Rand is the source of randomness for new session IDs. If nil,
+	// crypto/rand is used.
+	Rand io.Reader
+	// IDEncoding encodes the random bytes of new session IDs. If nil,
+	// base32.StdEncoding is used; base64.RawURLEncoding gives shorter IDs.
+	// Existing IDs stay valid when it changes.
+	IDEncoding IDEncoding
+	// Serializer encodes session values on save. If nil, GobSerializer is
+	// used. Values written with any registered serializer can be loaded.
+	Serializer Serializer
+	// Compressor, if set, compresses serialized values on save.
+	Compressor Compressor
+	// Transforms are applied in order to the serialized and compressed
+	// values on save, e.g. to encrypt them with an AESGCMTransform. Blobs
+	// are unwrapped on load according to their headers, whatever
+	// combination of steps wrote them, but a blob lacking the envelope of
+	// one of the Transforms is rejected as corrupt: adding a transform
+	// drops the sessions stored without it. Saves and loads fail if a tag
+	// is reserved, see Transform, or used by two of the Transforms.
+	Transforms []Transform
+	// SkipEmptyNewSessions makes Save do nothing for a new session without
+	// values: no ID is generated, nothing is stored and no cookie is set.
+	// It saves work on anonymous and bot traffic.
+	SkipEmptyNewSessions bool
+	// TryAllCookies makes New try every cookie carrying the session name,
+	// using the first that decodes and refers to a stored session, instead
+	// of only the first cookie. It recovers sessions shadowed by a stale
+	// duplicate cookie sent by a buggy client or proxy.
+	TryAllCookies bool
+	// PersistEmpty makes Save store sessions without values, e.g. when an
+	// empty session is a meaningful state. By default such a save writes
+	// nothing and leaves any previously stored values in place. Either way,
+	// a session saved with a negative MaxAge, as on logout, is deleted only
+	// if PersistEmpty is set or it still has values, so clear the values
+	// and set PersistEmpty, or delete the stored session explicitly.
+	PersistEmpty bool
+	// OnlySetCookieOnNewID makes Save set the cookie only if the session is
+	// new, its ID changed or its options changed since it was loaded, to
+	// keep responses small. With a positive MaxAge the cookie's expiry in
+	// the browser is then no longer pushed back by every save.
+	OnlySetCookieOnNewID bool
+
+	mu                           sync.RWMutex // guards Codecs and entries
+	nonPersistentSessionDuration time.Duration
+	entries                      map[string]Session
+}
+
+// RotateKeys atomically replaces the store's codecs with ones built from
+// keyPairs. Use it instead of assigning Codecs while requests are in flight.
+//
+// See NewCookieStore() for a description of keyPairs.
+func (s *MapStore) RotateKeys(keyPairs ...[]byte) {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	s.mu.Lock()
+	s.Codecs = codecs
+	s.mu.Unlock()
+}
+
+// codecs returns the current codecs.
+func (s *MapStore) codecs() []securecookie.Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Codecs
+}
+
+// encoding returns the encoding used for stored session values.
+func (s *MapStore) encoding() blobEncoding {
+	return blobEncoding{s.Serializer, s.Compressor, s.Transforms}
+}
+
+// Get returns a session for the given name after adding it to the registry,
+// which makes sessions.Save and Middleware save it. For a read-only check,
+// call New instead: it returns a session that is neither registered nor
+// shared with other Get calls of the request.
+//
+// See CookieStore.Get().
+func (s *MapStore) Get(r *http.Request, name string) (*sessions.Session,
+	error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// See CookieStore.New().
+func (s *MapStore) New(r *http.Request, name string) (*sessions.Session,
+	error) {
+	if s.TryAllCookies {
+		return newFromEachCookie(r, name, cookieName(s.CookieNameFunc, name), s.newSession)
+	}
+	return s.newSession(r, name)
+}
+
+// newSession implements New for the first cookie with the given name.
+func (s *MapStore) newSession(r *http.Request, name string) (*sessions.Session,
+	error) {
+	session := newSession(s, name)
+	opts := *s.Options
+	if s.Domain != "" {
+		opts.Domain = s.Domain
+	}
+	if s.Path != "" {
+		opts.Path = s.Path
+	}
+	session.Options = &opts
+	session.IsNew = true
+	if cookie, errCookie := r.Cookie(cookieName(s.CookieNameFunc, name)); errCookie == nil {
+		if err := securecookie.DecodeMulti(cookie.Name, cookie.Value, &session.ID,
+			s.codecs()...); err != nil {
+			session.ID = ""
+			return session, fmt.Errorf("%w: %w", ErrCookieDecode, err)
+		}
+		err := s.load(session)
+		if isNotFound(err) {
+			resetSession(session)
+			setState(session, StateExpired)
+			return session, nil
+		}
+		if err != nil {
+			return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+		}
+		markLoaded(session)
+	}
+	return session, nil
+}
+
+// Save adds a single session to the response.
+func (s *MapStore) Save(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	defer releaseMeta(session)
+	if s.SkipEmptyNewSessions && session.IsNew && len(session.Values) == 0 {
+		return nil
+	}
+	if session.ID == "" {
+		id, err := newSessionID(s.Rand, s.IDEncoding)
+		if err != nil {
+			return err
+		}
+		session.ID = id
+	}
+	if err := s.save(session); err != nil {
+		return err
+	}
+	if s.OnlySetCookieOnNewID && cookieUnchanged(session) {
+		return nil
+	}
+	name := cookieName(s.CookieNameFunc, session.Name())
+	encoded, err := securecookie.EncodeMulti(name, session.ID,
+		s.codecs()...)
+	if err != nil {
+		return err
+	}
+	cookie := sessions.NewCookie(name, encoded, session.Options)
+	if err := checkCookiePrefix(cookie); err != nil {
+		return err
+	}
+	if err := checkCookieLength(cookie, s.MaxCookieLength); err != nil {
+		return err
+	}
+	return setCookie(r.Context(), w, cookie)
+}
+
+// save writes encoded session.Values to the map, honoring the same
+// expiration rules as the datastore store.
+func (s *MapStore) save(session *sessions.Session) error {
+	if !s.PersistEmpty && len(session.Values) == 0 {
+		// Don't need to write anything.
+		return nil
+	}
+	serialized, err := s.encoding().encode(session.ID, session.Values)
+	if err != nil {
+		return err
+	}
+	expiration := sessionExpiration(session.Options, s.nonPersistentSessionDuration)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if expiration <= 0 {
+		delete(s.entries, session.ID)
+		return nil
+	}
+	now := time.Now()
+	s.entries[session.ID] = Session{
+		Date:           now,
+		ExpirationDate: now.Add(expiration),
+		Value:          serialized,
+	}
+	return nil
+}
+
+// load gets a value from the map and decodes its content into
+// session.Values. Expired entries are removed and reported as missing.
+func (s *MapStore) load(session *sessions.Session) error {
+	s.mu.Lock()
+	entity, ok := s.entries[session.ID]
+	if ok && !time.Now().Before(entity.ExpirationDate) {
+		delete(s.entries, session.ID)
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errNoSuchMapSession
+	}
+	return s.encoding().decode(session.ID, entity.Value, &session.Values)
+}
+
+// RemoveExpired deletes all expired sessions from the map.
+func (s *MapStore) RemoveExpired() {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, entity := range s.entries {
+		if !now.Before(entity.ExpirationDate) {
+			delete(s.entries, id)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/sessions"
+)
+
+// saveCookie saves a session holding values with store and returns the
+// cookie set by Save.
+func saveCookie(t *testing.T, store sessions.Store, values map[interface{}]interface{}) *http.Cookie {
+	t.Helper()
+	r := testRequest()
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Save set %d cookies, want 1", len(cookies))
+	}
+	return cookies[0]
+}
+
+func TestRotateKeysConcurrent(t *testing.T) {
+	oldKey := []byte("0123456789abcdef0123456789abcdef")
+	store := NewMapStore(0, oldKey)
+	cookie := saveCookie(t, store, map[interface{}]interface{}{"user": "gopher"})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				r := httptest.NewRequest("GET", "/", nil)
+				r.AddCookie(cookie)
+				session, err := store.New(r, "session")
+				if err != nil {
+					errs <- err
+					return
+				}
+				if session.IsNew || session.Values["user"] != "gopher" {
+					errs <- fmt.Errorf("cookie did not load the session during rotation: %v", session.Values)
+					return
+				}
+				if err := store.Save(r, httptest.NewRecorder(), session); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		newKey := []byte(fmt.Sprintf("%032d", i))
+		// The old key stays second, so that cookies it signed still decode.
+		store.RotateKeys(newKey, nil, oldKey, nil)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestMapStoreMixedFormats(t *testing.T) {
+	zstd, err := NewZstdCompressor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewMapStore(0, []byte("0123456789abcdef0123456789abcdef"))
+	values := map[interface{}]interface{}{"user": "gopher", "admin": true}
+	cookies := []*http.Cookie{saveCookie(t, store, values)}
+
+	// Sessions written before each change of format must keep loading.
+	for _, change := range []func(){
+		func() { store.Serializer = JSONSerializer{} },
+		func() { store.Serializer, store.Compressor = CompactSerializer{}, zstd },
+		func() { store.Serializer = GobSerializer{} },
+	} {
+		change()
+		for i, cookie := range cookies {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookie)
+			session, err := store.New(r, "session")
+			if err != nil {
+				t.Fatalf("session %d: %v", i, err)
+			}
+			if !reflect.DeepEqual(session.Values, values) {
+				t.Fatalf("session %d: loaded %v, want %v", i, session.Values, values)
+			}
+		}
+		cookies = append(cookies, saveCookie(t, store, values))
+	}
+}
+
+func TestMapStoreCorruptBlob(t *testing.T) {
+	store := NewMapStore(0, []byte("0123456789abcdef0123456789abcdef"))
+	cookie := saveCookie(t, store, map[interface{}]interface{}{"user": "gopher"})
+	for id, entity := range store.entries {
+		entity.Value = append([]byte{FormatCompact}, "not a compact blob"...)
+		store.entries[id] = entity
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	session, err := store.New(r, "session")
+	if !errors.Is(err, ErrSessionLoad) || !errors.Is(err, ErrCorruptSession) {
+		t.Fatalf("New with a corrupt blob returned error %v, want ErrSessionLoad and ErrCorruptSession", err)
+	}
+	if len(session.Values) != 0 {
+		t.Fatalf("New with a corrupt blob left values %v", session.Values)
+	}
+}
+
+func TestSaveForeignSession(t *testing.T) {
+	store := NewMapStore(0, conformanceKey)
+	// A session embedded in another value, and one that already has a
+	// finalizer, used to abort the program when Save attached metadata.
+	var wrapper struct {
+		user    string
+		Session sessions.Session
+	}
+	wrapper.Session = *sessions.NewSession(store, "session")
+	finalized := sessions.NewSession(store, "session")
+	runtime.SetFinalizer(finalized, func(*sessions.Session) {})
+
+	for _, session := range []*sessions.Session{&wrapper.Session, finalized} {
+		session.Values["user"] = "gopher"
+		w := httptest.NewRecorder()
+		if err := store.Save(testRequest(), w, session); err != nil {
+			t.Fatal(err)
+		}
+		if peekMeta(session) != nil {
+			t.Error("Save kept the metadata of a session the package did not allocate")
+		}
+		got, err := loadCookie(store, w.Result().Cookies()[0])
+		if err != nil || got.IsNew || got.Values["user"] != "gopher" {
+			t.Fatalf("New after saving a foreign session returned IsNew %v, values %v, error %v",
+				got.IsNew, got.Values, err)
+		}
+	}
+}
+
+func TestSkipEmptyNewSessions(t *testing.T) {
+	store := NewMapStore(0, []byte("0123456789abcdef0123456789abcdef"))
+	store.SkipEmptyNewSessions = true
+	r := httptest.NewRequest("GET", "/", nil)
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	if session.ID != "" || len(store.entries) != 0 || len(w.Result().Cookies()) != 0 {
+		t.Fatalf("Save of an empty new session set ID %q, stored %d sessions and set cookies %v",
+			session.ID, len(store.entries), w.Result().Cookies())
+	}
+}
+
+// BenchmarkSaveEmptyNewSession saves the empty new session of an anonymous
+// request, as most bot traffic does, with and without SkipEmptyNewSessions.
+func BenchmarkSaveEmptyNewSession(b *testing.B) {
+	for _, skip := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Skip=%v", skip), func(b *testing.B) {
+			store := NewMapStore(0, []byte("0123456789abcdef0123456789abcdef"))
+			store.SkipEmptyNewSessions = skip
+			r := httptest.NewRequest("GET", "/", nil)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				session, err := store.New(r, "session")
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := store.Save(r, nopResponseWriter{}, session); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
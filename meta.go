@@ -0,0 +1,103 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"runtime"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/gorilla/sessions"
+)
+
+// Metadata -------------------------------------------------------------------
+
+// sessionMeta is what the package knows about a session besides its values:
+// how New came up with it and what was last loaded or saved. It is kept out
+// of session.Values, where callers iterating the values and stores encoding
+// them would see it.
+type sessionMeta struct {
+	state   SessionState
+	loaded  *loadedCookie // see markLoaded
+	saved   *savedSession // see markSaved
+	version int64         // version of the stored session, see Version
+	hash    []byte        // hash of the stored blob, see SafeWrite
+	created time.Time     // Created of the stored session
+	labels  map[string]string
+	indexed []string
+}
+
+// metas holds the metadata of sessions allocated by newSession, keyed by
+// their address rather than by pointer so that the map does not keep them
+// alive. An entry is removed by a finalizer once its session is garbage
+// collected, which happens before the address can be reused.
+//
+// Sessions the package did not allocate, e.g. a sessions.Session embedded in
+// a caller's struct and passed to Save by address, cannot be given a
+// finalizer: runtime.SetFinalizer aborts the program for a pointer into the
+// middle of an allocation, or for one that already has a finalizer. Their
+// metadata is kept in foreignMetas for the duration of a Save only, see
+// releaseMeta.
+var (
+	metasMu      sync.Mutex
+	metas        = make(map[uintptr]*sessionMeta)
+	foreignMetas = make(map[uintptr]*sessionMeta)
+)
+
+// newSession returns a new session of store, as sessions.NewSession does,
+// with an empty metadata record attached to it.
+func newSession(store sessions.Store, name string) *sessions.Session {
+	session := sessions.NewSession(store, name)
+	metasMu.Lock()
+	metas[uintptr(unsafe.Pointer(session))] = new(sessionMeta)
+	metasMu.Unlock()
+	runtime.SetFinalizer(session, dropMeta)
+	return session
+}
+
+// metaOf returns the metadata of session, attaching an empty record to it if
+// it has none.
+func metaOf(session *sessions.Session) *sessionMeta {
+	p := uintptr(unsafe.Pointer(session))
+	metasMu.Lock()
+	defer metasMu.Unlock()
+	if m, ok := metas[p]; ok {
+		return m
+	}
+	m, ok := foreignMetas[p]
+	if !ok {
+		m = new(sessionMeta)
+		foreignMetas[p] = m
+	}
+	return m
+}
+
+// peekMeta returns the metadata of session, or nil if it has none.
+func peekMeta(session *sessions.Session) *sessionMeta {
+	p := uintptr(unsafe.Pointer(session))
+	metasMu.Lock()
+	defer metasMu.Unlock()
+	if m, ok := metas[p]; ok {
+		return m
+	}
+	return foreignMetas[p]
+}
+
+// releaseMeta forgets the metadata of session unless it was allocated by
+// newSession. The stores' Save methods defer it, so that the metadata of a
+// session the package did not allocate lasts until the end of its save.
+func releaseMeta(session *sessions.Session) {
+	metasMu.Lock()
+	delete(foreignMetas, uintptr(unsafe.Pointer(session)))
+	metasMu.Unlock()
+}
+
+// dropMeta removes the metadata of a session that is being collected.
+func dropMeta(session *sessions.Session) {
+	metasMu.Lock()
+	delete(metas, uintptr(unsafe.Pointer(session)))
+	metasMu.Unlock()
+}
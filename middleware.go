@@ -0,0 +1,129 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+
+	"google.golang.org/appengine"
+
+	"golang.org/x/net/context"
+
+	"github.com/gorilla/sessions"
+)
+
+// Middleware -----------------------------------------------------------------
+
+// Middleware returns a handler that calls next and then saves every session
+// registered for the request with Get, so handlers do not have to call Save
+// themselves.
+//
+// Sessions are saved just before the response headers are written, since
+// cookies cannot be set afterwards. If next never writes a response they are
+// saved when it returns. With BatchTasks, the AsyncWrite tasks of those
+// saves are added to the queue together, see WithTaskBatch. Save errors are
+// passed to SaveErrorFunc, or logged if it is nil.
+func (s *DatastoreStore) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch *TaskBatch
+		if s.BatchTasks {
+			var c context.Context
+			c, batch = WithTaskBatch(r.Context())
+			r = r.WithContext(c)
+		}
+		// Attach the registry up front so that sessions from every store
+		// used by next end up in the same one, saved with the batch.
+		sessions.GetRegistry(r)
+		sw := &savingResponseWriter{
+			ResponseWriter: w,
+			r:              r,
+			batch:          batch,
+			onError:        s.SaveErrorFunc,
+		}
+		next.ServeHTTP(sw, r)
+		sw.save()
+	})
+}
+
+// savingResponseWriter saves the sessions in a request's registry before the
+// first write to the underlying ResponseWriter.
+type savingResponseWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	batch       *TaskBatch
+	onError     func(r *http.Request, err error)
+	saved       bool
+	wroteHeader bool
+}
+
+// save saves the registered sessions once.
+func (w *savingResponseWriter) save() {
+	if w.saved {
+		return
+	}
+	w.saved = true
+	err := sessions.Save(w.r, w.ResponseWriter)
+	if w.batch != nil {
+		if flushErr := w.batch.Flush(w.r.Context()); err == nil {
+			err = flushErr
+		}
+	}
+	if err != nil {
+		if w.onError != nil {
+			w.onError(w.r, err)
+			return
+		}
+		c := appengine.NewContext(w.r)
+		logger(c).Errorf(c, "gaesessions: saving sessions: %v", err)
+	}
+}
+
+func (w *savingResponseWriter) WriteHeader(code int) {
+	w.save()
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *savingResponseWriter) Write(b []byte) (int, error) {
+	w.save()
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// headersWritten reports whether the response headers have been written, so
+// that a Save made after that fails with ErrHeadersSent.
+func (w *savingResponseWriter) headersWritten() bool {
+	return w.wroteHeader
+}
+
+// Flush implements http.Flusher if the underlying ResponseWriter does.
+func (w *savingResponseWriter) Flush() {
+	w.save()
+	w.wroteHeader = true
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying ResponseWriter does,
+// saving the sessions before handing the connection over to the caller.
+func (w *savingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("gaesessions: ResponseWriter does not implement http.Hijacker")
+	}
+	w.save()
+	w.wroteHeader = true
+	return h.Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter, so that
+// http.ResponseController can reach the methods it implements.
+func (w *savingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,54 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// hijackRecorder is a ResponseRecorder whose connection can be hijacked.
+type hijackRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (w *hijackRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.hijacked = true
+	return nil, nil, nil
+}
+
+func TestSavingResponseWriterHijack(t *testing.T) {
+	r := testRequest()
+	store := NewMapStore(0, conformanceKey)
+	session, err := store.Get(r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user"] = "gopher"
+
+	w := &hijackRecorder{ResponseRecorder: httptest.NewRecorder()}
+	sw := &savingResponseWriter{ResponseWriter: w, r: r}
+	if sw.Unwrap() != w {
+		t.Fatal("Unwrap did not return the underlying ResponseWriter")
+	}
+	if _, _, err := http.NewResponseController(sw).Hijack(); err != nil {
+		t.Fatalf("Hijack: %v", err)
+	}
+	if !w.hijacked {
+		t.Fatal("Hijack did not reach the underlying ResponseWriter")
+	}
+	if !sw.saved || len(w.Result().Cookies()) != 1 {
+		t.Fatalf("Hijack saved %v and set cookies %v, want the session saved first", sw.saved, w.Result().Cookies())
+	}
+
+	sw = &savingResponseWriter{ResponseWriter: httptest.NewRecorder(), r: testRequest()}
+	if _, _, err := sw.Hijack(); err == nil {
+		t.Fatal("Hijack of a ResponseWriter that cannot be hijacked succeeded")
+	}
+}
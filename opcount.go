@@ -0,0 +1,75 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// Operation counts -----------------------------------------------------------
+
+// OpCounts counts the billable operations made by the stores on behalf of a
+// context returned by WithOpCounts. The counts are updated atomically; read
+// them once the session operations of interest have returned.
+type OpCounts struct {
+	DatastoreReads    int64 // entities read
+	DatastoreWrites   int64 // entities written or deleted
+	DatastoreSmallOps int64 // key allocations
+	MemcacheOps       int64 // items read, written or deleted
+	Tasks             int64 // task queue tasks added
+}
+
+// opCountsKey is the context key set by WithOpCounts.
+type opCountsKey struct{}
+
+// WithOpCounts returns a copy of c that makes the stores count the
+// operations they make, and the counts, e.g. to attribute the cost of a
+// request's session handling:
+//
+//	c, ops := gaesessions.WithOpCounts(r.Context())
+//	r = r.WithContext(c)
+//	session, err := store.Get(r, "session")
+//	...
+//	log.Debugf(c, "session ops: %+v", *ops)
+func WithOpCounts(c context.Context) (context.Context, *OpCounts) {
+	counts := new(OpCounts)
+	return context.WithValue(c, opCountsKey{}, counts), counts
+}
+
+// opKind names a field of OpCounts.
+type opKind int
+
+const (
+	opDatastoreRead opKind = iota
+	opDatastoreWrite
+	opDatastoreSmall
+	opMemcache
+	opTask
+)
+
+// addOps adds n operations of the given kind to the counts carried by c, if
+// any.
+func addOps(c context.Context, op opKind, n int) {
+	counts, _ := c.Value(opCountsKey{}).(*OpCounts)
+	if counts == nil {
+		return
+	}
+	var field *int64
+	switch op {
+	case opDatastoreRead:
+		field = &counts.DatastoreReads
+	case opDatastoreWrite:
+		field = &counts.DatastoreWrites
+	case opDatastoreSmall:
+		field = &counts.DatastoreSmallOps
+	case opMemcache:
+		field = &counts.MemcacheOps
+	case opTask:
+		field = &counts.Tasks
+	}
+	atomic.AddInt64(field, int64(n))
+}
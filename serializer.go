@@ -0,0 +1,458 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Serialization --------------------------------------------------------------
+
+// Stored blobs start with a one-byte format tag naming the serializer that
+// wrote them, so that the serializer used on save can change while sessions
+// written in the previous format remain readable. Blobs written before tags
+// were introduced carry no tag and are read as gob: a gob stream starts with
+// the length of its first message, which for session values is always the
+// 13-byte definition of map[interface{}]interface{}, so it cannot be mistaken
+// for one of the tags below. Serialized blobs may in turn be wrapped in
+// envelopes, e.g. compressed or encrypted, whose tags start at 0x80; see
+// transform.go.
+const (
+	FormatGob     byte = 0
+	FormatJSON    byte = 1
+	FormatCompact byte = 2
+)
+
+// gobStreamHead is the first byte of every untagged gob blob.
+const gobStreamHead byte = 0x0d
+
+// Serializer encodes and decodes session values.
+type Serializer interface {
+	// Format returns the tag written at the head of every blob produced by
+	// the serializer.
+	Format() byte
+	Serialize(src map[interface{}]interface{}) ([]byte, error)
+	Deserialize(src []byte, dst *map[interface{}]interface{}) error
+}
+
+var (
+	serializersMu sync.RWMutex
+	serializers   = map[byte]Serializer{
+		FormatGob:     GobSerializer{},
+		FormatJSON:    JSONSerializer{},
+		FormatCompact: CompactSerializer{},
+	}
+)
+
+// RegisterSerializer makes a serializer available for loading blobs tagged
+// with its format. The built-in gob, JSON and compact serializers are always
+// registered. Like gob.Register, it panics if the format is already in use,
+// is the first byte of untagged gob blobs or is in the range reserved for
+// envelopes (0x80 and above), since blobs could then be read with the wrong
+// serializer.
+func RegisterSerializer(s Serializer) {
+	f := s.Format()
+	if f == gobStreamHead || f >= formatCompressed {
+		panic(fmt.Sprintf("gaesessions: serializer format %#x is reserved", f))
+	}
+	serializersMu.Lock()
+	defer serializersMu.Unlock()
+	if _, ok := serializers[f]; ok {
+		panic(fmt.Sprintf("gaesessions: serializer format %#x registered twice", f))
+	}
+	serializers[f] = s
+}
+
+// blobEncoding turns session values into stored blobs and back, according to
+// a store's configuration.
+type blobEncoding struct {
+	serializer Serializer
+	compressor Compressor
+	transforms []Transform
+}
+
+// encode serializes values, compresses the result if a compressor is
+// configured and applies the transforms for the session with the given ID.
+// It fails if the transforms are misconfigured, see checkTransforms.
+func (e blobEncoding) encode(id string, values map[interface{}]interface{}) ([]byte, error) {
+	if err := checkTransforms(e.transforms); err != nil {
+		return nil, err
+	}
+	b, err := serialize(e.serializer, values)
+	if err != nil {
+		return nil, err
+	}
+	if e.compressor != nil {
+		if b, err = compress(e.compressor, b); err != nil {
+			return nil, err
+		}
+	}
+	for _, t := range e.transforms {
+		if b, err = t.Wrap(b, id); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// decode unwraps the envelopes around src, the blob of the session with the
+// given ID, and deserializes the result into dst. A blob lacking the envelope
+// of one of the configured transforms is rejected, so that e.g. encryption
+// cannot be stripped by whoever can write to the backing store. Errors are
+// wrapped with ErrCorruptSession, except those of misconfigured transforms.
+func (e blobEncoding) decode(id string, src []byte, dst *map[interface{}]interface{}) error {
+	if err := checkTransforms(e.transforms); err != nil {
+		*dst = make(map[interface{}]interface{})
+		return err
+	}
+	var unwrapped []byte
+	for len(src) > 0 && src[0] >= formatCompressed {
+		var err error
+		if src[0] == formatCompressed {
+			src, err = decompress(e.compressor, src)
+		} else {
+			unwrapped = append(unwrapped, src[0])
+			src, err = unwrap(e.transforms, src, id)
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrCorruptSession, err)
+		}
+	}
+	for _, t := range e.transforms {
+		if bytes.IndexByte(unwrapped, t.Tag()) < 0 {
+			*dst = make(map[interface{}]interface{})
+			return fmt.Errorf("%w: missing envelope 0x%02x", ErrCorruptSession, t.Tag())
+		}
+	}
+	return deserialize(src, dst)
+}
+
+// digest returns a hash of values as the serializer encodes them, telling
+// whether they changed between two saves. Transforms are left out, since
+// encryption makes every blob differ. The entries are encoded one by one and
+// sorted, so that the hash does not depend on the iteration order of the
+// map; equal values holding maps may still hash differently, which only
+// costs a redundant write.
+func (e blobEncoding) digest(values map[interface{}]interface{}) ([]byte, error) {
+	entries := make([][]byte, 0, len(values))
+	for k, v := range values {
+		b, err := serialize(e.serializer, map[interface{}]interface{}{k: v})
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, b)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i], entries[j]) < 0
+	})
+	h := sha256.New()
+	var n [binary.MaxVarintLen64]byte
+	for _, b := range entries {
+		h.Write(n[:binary.PutUvarint(n[:], uint64(len(b)))])
+		h.Write(b)
+	}
+	return h.Sum(nil), nil
+}
+
+// serialize encodes a value with s, or with gob if s is nil, and prefixes
+// the result with the serializer's format tag. Values the compact serializer
+// cannot represent are encoded with gob instead.
+func serialize(s Serializer, src map[interface{}]interface{}) ([]byte, error) {
+	if s == nil {
+		s = GobSerializer{}
+	}
+	b, err := s.Serialize(src)
+	if err == errCompactUnsupported {
+		s = GobSerializer{}
+		b, err = s.Serialize(src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w%s: %w", ErrUnserializableValue, culprit(s, src), err)
+	}
+	return append([]byte{s.Format()}, b...), nil
+}
+
+// culprit describes the first value of src that s fails to serialize on its
+// own, or returns "" if there is none.
+func culprit(s Serializer, src map[interface{}]interface{}) string {
+	for k, v := range src {
+		if _, err := s.Serialize(map[interface{}]interface{}{k: v}); err != nil {
+			return fmt.Sprintf(" (key %v holds %T)", k, v)
+		}
+	}
+	return ""
+}
+
+// deserialize decodes a value using the serializer named by its format tag.
+// Untagged blobs are decoded using gob. If a tagged blob fails to decode it
+// is retried as an untagged gob blob, in case a legacy blob happens to start
+// with a tag. Decoding errors are wrapped with ErrCorruptSession.
+//
+// dst is replaced rather than merged into, so that values left over from an
+// earlier load of a reused session do not survive, and is left empty if
+// decoding fails rather than partially populated.
+func deserialize(src []byte, dst *map[interface{}]interface{}) error {
+	*dst = make(map[interface{}]interface{})
+	if len(src) > 0 {
+		serializersMu.RLock()
+		tagged, ok := serializers[src[0]]
+		serializersMu.RUnlock()
+		if ok {
+			err := tagged.Deserialize(src[1:], dst)
+			if err == nil {
+				return nil
+			}
+			*dst = make(map[interface{}]interface{})
+			if (GobSerializer{}).Deserialize(src, dst) == nil {
+				return nil
+			}
+			*dst = make(map[interface{}]interface{})
+			return fmt.Errorf("%w: format %d: %w", ErrCorruptSession, src[0], err)
+		}
+	}
+	if err := (GobSerializer{}).Deserialize(src, dst); err != nil {
+		*dst = make(map[interface{}]interface{})
+		return fmt.Errorf("%w: %w", ErrCorruptSession, err)
+	}
+	return nil
+}
+
+// GobSerializer encodes session values using gob. Custom types stored in a
+// session must be registered with gob.Register.
+type GobSerializer struct{}
+
+// Format returns FormatGob.
+func (GobSerializer) Format() byte { return FormatGob }
+
+// Serialize encodes a value using gob.
+func (GobSerializer) Serialize(src map[interface{}]interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	enc := gob.NewEncoder(buf)
+	if err := enc.Encode(src); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Deserialize decodes a value using gob.
+func (GobSerializer) Deserialize(src []byte, dst *map[interface{}]interface{}) error {
+	dec := gob.NewDecoder(bytes.NewBuffer(src))
+	if err := dec.Decode(dst); err != nil {
+		return err
+	}
+	return nil
+}
+
+// JSONSerializer encodes session values as a JSON object. All keys must be
+// strings, and values are decoded into the types produced by encoding/json
+// (e.g. numbers become float64).
+type JSONSerializer struct{}
+
+// Format returns FormatJSON.
+func (JSONSerializer) Format() byte { return FormatJSON }
+
+// Serialize encodes a value using JSON.
+func (JSONSerializer) Serialize(src map[interface{}]interface{}) ([]byte, error) {
+	m := make(map[string]interface{}, len(src))
+	for k, v := range src {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("gaesessions: JSON serializer requires string keys, got %T", k)
+		}
+		m[ks] = v
+	}
+	return json.Marshal(m)
+}
+
+// Deserialize decodes a value using JSON.
+func (JSONSerializer) Deserialize(src []byte, dst *map[interface{}]interface{}) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(src, &m); err != nil {
+		return err
+	}
+	if *dst == nil {
+		*dst = make(map[interface{}]interface{}, len(m))
+	}
+	for k, v := range m {
+		(*dst)[k] = v
+	}
+	return nil
+}
+
+// CompactSerializer encodes session values as a stream of length-prefixed
+// key/value pairs, without the type descriptions gob writes, which make up
+// most of a small session. Keys must be strings and values one of string,
+// bool, int, int64, float64 or []byte; sessions holding anything else are
+// stored with gob instead, so CompactSerializer can be used for any store.
+type CompactSerializer struct{}
+
+// errCompactUnsupported is returned by CompactSerializer.Serialize for
+// values it cannot encode; serialize then falls back to gob.
+var errCompactUnsupported = errors.New("gaesessions: value not supported by compact serializer")
+
+// Value type tags of the compact format.
+const (
+	compactString byte = iota
+	compactBool
+	compactInt
+	compactInt64
+	compactFloat64
+	compactBytes
+)
+
+// Format returns FormatCompact.
+func (CompactSerializer) Format() byte { return FormatCompact }
+
+// Serialize encodes a value using the compact format.
+func (CompactSerializer) Serialize(src map[interface{}]interface{}) ([]byte, error) {
+	b := binary.AppendUvarint(nil, uint64(len(src)))
+	for k, v := range src {
+		ks, ok := k.(string)
+		if !ok {
+			return nil, errCompactUnsupported
+		}
+		b = appendCompactBytes(b, []byte(ks))
+		switch v := v.(type) {
+		case string:
+			b = appendCompactBytes(append(b, compactString), []byte(v))
+		case bool:
+			t := byte(0)
+			if v {
+				t = 1
+			}
+			b = append(b, compactBool, t)
+		case int:
+			b = binary.AppendVarint(append(b, compactInt), int64(v))
+		case int64:
+			b = binary.AppendVarint(append(b, compactInt64), v)
+		case float64:
+			b = binary.BigEndian.AppendUint64(append(b, compactFloat64), math.Float64bits(v))
+		case []byte:
+			b = appendCompactBytes(append(b, compactBytes), v)
+		default:
+			return nil, errCompactUnsupported
+		}
+	}
+	return b, nil
+}
+
+// Deserialize decodes a value using the compact format.
+func (CompactSerializer) Deserialize(src []byte, dst *map[interface{}]interface{}) error {
+	r := compactReader{src: src}
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(src)) {
+		r.err = errors.New("gaesessions: compact value count too large")
+	}
+	if *dst == nil {
+		*dst = make(map[interface{}]interface{}, n)
+	}
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		k := string(r.bytes())
+		var v interface{}
+		switch t := r.byte(); t {
+		case compactString:
+			v = string(r.bytes())
+		case compactBool:
+			v = r.byte() != 0
+		case compactInt:
+			v = int(r.varint())
+		case compactInt64:
+			v = r.varint()
+		case compactFloat64:
+			v = math.Float64frombits(binary.BigEndian.Uint64(r.next(8)))
+		case compactBytes:
+			v = append([]byte(nil), r.bytes()...)
+		default:
+			if r.err == nil {
+				r.err = fmt.Errorf("gaesessions: unknown compact value type %d", t)
+			}
+		}
+		if r.err == nil {
+			(*dst)[k] = v
+		}
+	}
+	if r.err == nil && len(r.src) > 0 {
+		r.err = errors.New("gaesessions: trailing data after compact values")
+	}
+	return r.err
+}
+
+// appendCompactBytes appends p to b prefixed with its length.
+func appendCompactBytes(b, p []byte) []byte {
+	return append(binary.AppendUvarint(b, uint64(len(p))), p...)
+}
+
+// compactReader reads the compact format, remembering the first error.
+type compactReader struct {
+	src []byte
+	err error
+}
+
+// errCompactTruncated is recorded when the input ends early.
+var errCompactTruncated = errors.New("gaesessions: truncated compact value")
+
+// next returns the next n bytes, or n zero bytes after an error.
+func (r *compactReader) next(n int) []byte {
+	if r.err == nil && n > len(r.src) {
+		r.err = errCompactTruncated
+	}
+	if r.err != nil {
+		return make([]byte, n)
+	}
+	p := r.src[:n]
+	r.src = r.src[n:]
+	return p
+}
+
+func (r *compactReader) byte() byte {
+	return r.next(1)[0]
+}
+
+func (r *compactReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.src)
+	if n <= 0 {
+		r.err = errCompactTruncated
+		return 0
+	}
+	r.src = r.src[n:]
+	return v
+}
+
+func (r *compactReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.src)
+	if n <= 0 {
+		r.err = errCompactTruncated
+		return 0
+	}
+	r.src = r.src[n:]
+	return v
+}
+
+// bytes returns a length-prefixed byte string.
+func (r *compactReader) bytes() []byte {
+	n := r.uvarint()
+	if r.err == nil && n > uint64(len(r.src)) {
+		r.err = errCompactTruncated
+	}
+	if r.err != nil {
+		return nil
+	}
+	return r.next(int(n))
+}
@@ -0,0 +1,278 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fuzzPoint is a custom type stored in sessions, registered with gob as
+// callers of the package must.
+type fuzzPoint struct {
+	X, Y int
+}
+
+func init() {
+	gob.Register(fuzzPoint{})
+	gob.Register(map[string]interface{}{})
+	gob.Register([]interface{}{})
+}
+
+// builtinSerializers are the serializers every store can be configured with.
+var builtinSerializers = []Serializer{GobSerializer{}, JSONSerializer{}, CompactSerializer{}}
+
+// valueGen derives session values from fuzzer input, yielding zeros once the
+// input is exhausted.
+type valueGen struct {
+	b []byte
+}
+
+func (g *valueGen) byte() byte {
+	if len(g.b) == 0 {
+		return 0
+	}
+	c := g.b[0]
+	g.b = g.b[1:]
+	return c
+}
+
+func (g *valueGen) uint32() uint32 {
+	var p [4]byte
+	for i := range p {
+		p[i] = g.byte()
+	}
+	return binary.BigEndian.Uint32(p[:])
+}
+
+func (g *valueGen) bytes() []byte {
+	n := int(g.byte() % 16)
+	if n > len(g.b) {
+		n = len(g.b)
+	}
+	p := append([]byte{}, g.b[:n]...)
+	g.b = g.b[n:]
+	return p
+}
+
+// values returns a map of up to seven entries, with string keys unless
+// anyKeys is set.
+func (g *valueGen) values(depth int, anyKeys bool) map[interface{}]interface{} {
+	m := make(map[interface{}]interface{})
+	for n := g.byte() % 8; n > 0; n-- {
+		var k interface{} = string(g.bytes())
+		if anyKeys && g.byte()%4 == 0 {
+			k = int(int32(g.uint32()))
+		}
+		m[k] = g.value(depth)
+	}
+	return m
+}
+
+func (g *valueGen) value(depth int) interface{} {
+	switch t := g.byte() % 10; {
+	case t == 0:
+		return string(g.bytes())
+	case t == 1:
+		return g.byte()%2 == 1
+	case t == 2:
+		return int(int32(g.uint32()))
+	case t == 3:
+		return int64(g.uint32())<<32 | int64(g.uint32())
+	case t == 4:
+		return float64(int32(g.uint32())) / 8
+	case t == 5:
+		return g.bytes()
+	case t == 6:
+		return time.Unix(int64(g.uint32()), int64(g.uint32()%1e9)).UTC()
+	case t == 7:
+		return fuzzPoint{int(int16(g.uint32())), int(int16(g.uint32()))}
+	case t == 8 && depth < 2:
+		m := make(map[string]interface{})
+		for k, v := range g.values(depth+1, false) {
+			m[k.(string)] = v
+		}
+		return m
+	case t == 9 && depth < 2:
+		s := []interface{}{}
+		for n := g.byte() % 4; n > 0; n-- {
+			s = append(s, g.value(depth+1))
+		}
+		return s
+	}
+	return string(g.bytes())
+}
+
+// normalized returns v with empty slices replaced by nil ones, as gob does
+// not tell them apart.
+func normalized(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []byte:
+		if len(v) == 0 {
+			return []byte(nil)
+		}
+	case []interface{}:
+		if len(v) == 0 {
+			return []interface{}(nil)
+		}
+		s := make([]interface{}, len(v))
+		for i, e := range v {
+			s[i] = normalized(e)
+		}
+		return s
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalized(e)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			m[k] = normalized(e)
+		}
+		return m
+	}
+	return v
+}
+
+// roundTrip serializes values with s and deserializes the result into a
+// fresh map.
+func roundTrip(t *testing.T, s Serializer, values map[interface{}]interface{}) (map[interface{}]interface{}, bool) {
+	b, err := serialize(s, values)
+	if err != nil {
+		return nil, false
+	}
+	var got map[interface{}]interface{}
+	if err := deserialize(b, &got); err != nil {
+		t.Fatalf("%T: deserialize after serialize: %v\nvalues: %#v", s, err, values)
+	}
+	return got, true
+}
+
+func FuzzSerializeRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{3, 1, 'a', 0, 1, 'b', 1, 1, 0, 2, 0, 0, 0, 42})
+	f.Add([]byte{2, 1, 'n', 8, 2, 1, 'x', 6, 1, 2, 3, 4, 5, 6, 7, 8, 1, 'y', 9, 2, 7, 1, 2, 3, 4, 5, 6, 7, 8, 5, 3, 1, 2, 3})
+	f.Add([]byte{4, 0, 4, 1, 2, 3, 4, 1, 1, 't', 6, 0xff, 0, 0, 0, 0, 0, 0, 1, 0, 5, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		g := &valueGen{data}
+		values := g.values(0, true)
+		for _, s := range builtinSerializers {
+			got, ok := roundTrip(t, s, values)
+			if !ok {
+				continue
+			}
+			if _, isJSON := s.(JSONSerializer); isJSON {
+				// JSON changes the types of values, e.g. ints become
+				// float64, so only check that its output is stable.
+				again, ok := roundTrip(t, s, got)
+				if !ok {
+					t.Fatalf("JSONSerializer: cannot serialize its own output %#v", got)
+				}
+				if !reflect.DeepEqual(again, got) {
+					t.Fatalf("JSONSerializer: round trip of %#v gave %#v", got, again)
+				}
+				continue
+			}
+			if !reflect.DeepEqual(normalized(got), normalized(values)) {
+				t.Fatalf("%T: round trip of %#v gave %#v", s, values, got)
+			}
+		}
+	})
+}
+
+func TestDeserializeReplacesValues(t *testing.T) {
+	for _, s := range builtinSerializers {
+		b, err := serialize(s, map[interface{}]interface{}{"fresh": "yes"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[interface{}]interface{}{"stale": "yes", "fresh": "no"}
+		if err := deserialize(b, &values); err != nil {
+			t.Fatalf("%T: %v", s, err)
+		}
+		want := map[interface{}]interface{}{"fresh": "yes"}
+		if !reflect.DeepEqual(values, want) {
+			t.Errorf("%T: deserialize into a populated map gave %v, want %v", s, values, want)
+		}
+
+		values = map[interface{}]interface{}{"stale": "yes"}
+		if err := deserialize(b[:len(b)-1], &values); err == nil {
+			t.Errorf("%T: deserialize of a truncated blob succeeded", s)
+		}
+		if len(values) != 0 {
+			t.Errorf("%T: failed deserialize left %v, want no values", s, values)
+		}
+	}
+}
+
+func TestDeserializeEmpty(t *testing.T) {
+	for _, s := range builtinSerializers {
+		for _, src := range []map[interface{}]interface{}{nil, {}} {
+			b, err := serialize(s, src)
+			if err != nil {
+				t.Fatalf("%T: %v", s, err)
+			}
+			values := map[interface{}]interface{}{"stale": "yes"}
+			if err := deserialize(b, &values); err != nil {
+				t.Fatalf("%T: %v", s, err)
+			}
+			if values == nil || len(values) != 0 {
+				t.Errorf("%T: deserialize of %#v gave %#v, want an empty map", s, src, values)
+			}
+		}
+	}
+}
+
+// BenchmarkSerializeSmall serializes a typical two-field session, reporting
+// the size of the blob each serializer stores.
+func BenchmarkSerializeSmall(b *testing.B) {
+	values := map[interface{}]interface{}{"user_id": "u-12345", "visits": 7}
+	for _, s := range builtinSerializers {
+		b.Run(reflect.TypeOf(s).Name(), func(b *testing.B) {
+			var n int
+			for i := 0; i < b.N; i++ {
+				blob, err := serialize(s, values)
+				if err != nil {
+					b.Fatal(err)
+				}
+				n = len(blob)
+			}
+			b.ReportMetric(float64(n), "bytes/session")
+		})
+	}
+}
+
+func TestCompactSmallerThanGob(t *testing.T) {
+	values := map[interface{}]interface{}{"user_id": "u-12345", "visits": 7}
+	gobBlob, err := serialize(GobSerializer{}, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compactBlob, err := serialize(CompactSerializer{}, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compactBlob[0] != FormatCompact {
+		t.Fatalf("compact blob has format %d, want %d", compactBlob[0], FormatCompact)
+	}
+	if len(compactBlob) >= len(gobBlob) {
+		t.Fatalf("compact blob is %d bytes, gob blob %d", len(compactBlob), len(gobBlob))
+	}
+}
+
+func TestCompactFallsBackToGob(t *testing.T) {
+	b, err := serialize(CompactSerializer{}, map[interface{}]interface{}{"point": fuzzPoint{1, 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != FormatGob {
+		t.Fatalf("blob with an unsupported value has format %d, want %d", b[0], FormatGob)
+	}
+}
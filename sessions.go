@@ -6,16 +6,28 @@ package gaesessions
 
 import (
 	"bytes"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
 	"encoding/base32"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	mathrand "math/rand"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
-	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/delay"
 	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/taskqueue"
 
 	"golang.org/x/net/context"
 
@@ -25,8 +37,529 @@ import (
 	"github.com/gorilla/sessions"
 )
 
+var (
+	// ErrCookieDecode is returned by New when the session cookie cannot be
+	// decoded, e.g. because it was tampered with or signed with a retired
+	// key. The session returned alongside it is a fresh one.
+	ErrCookieDecode = errors.New("gaesessions: cannot decode session cookie")
+	// ErrSessionLoad is returned by New when the session referenced by the
+	// cookie cannot be loaded from the backing store.
+	ErrSessionLoad = errors.New("gaesessions: cannot load session")
+	// ErrCanceled is returned when a session operation is abandoned because
+	// the request context was cancelled or its deadline passed. The error
+	// also matches the context's own error, e.g. context.DeadlineExceeded.
+	ErrCanceled = errors.New("gaesessions: session operation canceled")
+	// ErrCorruptSession is returned when stored session data cannot be
+	// decoded.
+	ErrCorruptSession = errors.New("gaesessions: corrupt session data")
+	// ErrSessionExpired is returned when a stored session is found but has
+	// expired and has not been removed yet.
+	ErrSessionExpired = errors.New("gaesessions: session expired")
+	// ErrCookieTooLong is returned by Save when the encoded session cookie
+	// exceeds the store's MaxCookieLength.
+	ErrCookieTooLong = errors.New("gaesessions: session cookie too long")
+	// ErrIDCollision is returned by Save when CheckIDCollision is set and
+	// every ID generated for a new session was already taken, which points
+	// to a broken Rand.
+	ErrIDCollision = errors.New("gaesessions: session ID already in use")
+	// ErrInvalidCookiePrefix is returned by Save when the session cookie's
+	// name starts with "__Host-" or "__Secure-" but the cookie lacks the
+	// attributes browsers require for that prefix: Secure, and for
+	// "__Host-" also Path "/" and no Domain.
+	ErrInvalidCookiePrefix = errors.New("gaesessions: cookie options do not match cookie name prefix")
+	// ErrVersionConflict is returned by Save when OptimisticLocking is
+	// enabled and the stored session was modified after it was loaded.
+	ErrVersionConflict = errors.New("gaesessions: session modified concurrently")
+	// ErrHeadersSent is returned by Save when the session was stored but its
+	// cookie could not be set because the response headers had already been
+	// written. See WithoutCookie.
+	ErrHeadersSent = errors.New("gaesessions: response headers already sent")
+	// ErrConcurrentModification is returned by Save when SafeWrite is
+	// enabled and the stored session changed after it was loaded.
+	ErrConcurrentModification = errors.New("gaesessions: stored session changed since load")
+	// ErrUnserializableValue is returned by Save when the session values
+	// cannot be serialized, e.g. because a custom type was not registered
+	// with gob.Register. The error names the offending key and type.
+	ErrUnserializableValue = errors.New("gaesessions: cannot serialize session value")
+	// ErrValueTooLarge is returned by Save when the serialized session
+	// exceeds the size memcache accepts for an item.
+	ErrValueTooLarge = errors.New("gaesessions: session too large for memcache")
+)
+
+// IDEncoding turns random bytes into the text of a session ID. Both
+// *base32.Encoding and *base64.Encoding implement it.
+type IDEncoding interface {
+	EncodeToString(src []byte) string
+}
+
+// newSessionID returns a new session ID made of 32 bytes read from rand, or
+// from crypto/rand if rand is nil, encoded with enc, or base32 if enc is nil,
+// with the padding trimmed.
+func newSessionID(rand io.Reader, enc IDEncoding) (string, error) {
+	if rand == nil {
+		rand = cryptorand.Reader
+	}
+	if enc == nil {
+		enc = base32.StdEncoding
+	}
+	b := make([]byte, 32)
+	if _, err := io.ReadFull(rand, b); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(enc.EncodeToString(b), "="), nil
+}
+
+// sessionIDLen returns the length of the IDs newSessionID returns for enc.
+func sessionIDLen(enc IDEncoding) int {
+	if enc == nil {
+		enc = base32.StdEncoding
+	}
+	return len(strings.TrimRight(enc.EncodeToString(make([]byte, 32)), "="))
+}
+
+// sessionExpiration returns how long a session saved with options lives,
+// following the cookie semantics of MaxAge: its MaxAge if positive, zero
+// (meaning the session must be deleted) if negative, and for a browser
+// session cookie, with a MaxAge of zero, nonPersistentSessionDuration, or
+// DefaultNonPersistentSessionDuration if that is not positive.
+func sessionExpiration(options *sessions.Options,
+	nonPersistentSessionDuration time.Duration) time.Duration {
+	switch {
+	case options.MaxAge > 0:
+		return time.Duration(options.MaxAge) * time.Second
+	case options.MaxAge < 0:
+		return 0
+	case nonPersistentSessionDuration > 0:
+		return nonPersistentSessionDuration
+	}
+	return DefaultNonPersistentSessionDuration
+}
+
+// DefaultSecure is the Secure option the constructors give new stores, so
+// that their session cookies are only sent over HTTPS. It is true except on
+// the development server. An app serving sessions over plain HTTP can clear
+// it before creating its stores rather than change the options of each.
+var DefaultSecure = !appengine.IsDevAppServer()
+
+// defaultOptions returns the options the constructors give new stores:
+// cookies last 30 days, are hidden from scripts and are only sent over HTTPS
+// if DefaultSecure is set.
+func defaultOptions() *sessions.Options {
+	return &sessions.Options{
+		Path:     "/",
+		MaxAge:   86400 * 30,
+		Secure:   DefaultSecure,
+		HttpOnly: true,
+	}
+}
+
+// defaultMaxCookieLength is the cookie size all major browsers accept.
+const defaultMaxCookieLength = 4096
+
+// checkCookieLength returns an error wrapping ErrCookieTooLong if the length
+// of the cookie's name and value exceeds max. See MaxCookieLength.
+func checkCookieLength(cookie *http.Cookie, max int) error {
+	if max == 0 {
+		max = defaultMaxCookieLength
+	}
+	if n := len(cookie.Name) + len(cookie.Value); max > 0 && n > max {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrCookieTooLong, n, max)
+	}
+	return nil
+}
+
+// checkCookiePrefix returns an error wrapping ErrInvalidCookiePrefix if the
+// cookie's name has a prefix whose requirements its attributes do not meet,
+// so that browsers would silently drop it.
+func checkCookiePrefix(cookie *http.Cookie) error {
+	switch {
+	case strings.HasPrefix(cookie.Name, "__Host-"):
+		if !cookie.Secure || cookie.Path != "/" || cookie.Domain != "" {
+			return fmt.Errorf("%w: %s needs Secure, Path \"/\" and no Domain", ErrInvalidCookiePrefix, cookie.Name)
+		}
+	case strings.HasPrefix(cookie.Name, "__Secure-"):
+		if !cookie.Secure {
+			return fmt.Errorf("%w: %s needs Secure", ErrInvalidCookiePrefix, cookie.Name)
+		}
+	}
+	return nil
+}
+
+// cookieName returns the name of the cookie for the session with the given
+// name, as chosen by f if it is set.
+func cookieName(f func(sessionName string) string, name string) string {
+	if f != nil {
+		return f(name)
+	}
+	return name
+}
+
+// requestCookie returns the cookie of r with the given name, or the one
+// named legacyName if there is none and legacyName is set.
+func requestCookie(r *http.Request, name, legacyName string) (*http.Cookie, error) {
+	cookie, err := r.Cookie(name)
+	if err == http.ErrNoCookie && legacyName != "" {
+		return r.Cookie(legacyName)
+	}
+	return cookie, err
+}
+
+// CookieTransform adds a layer of protection to the session ID carried by
+// the cookie, e.g. encryption with a key derived per user, so that even the
+// holder of the store's keys cannot enumerate IDs. On Save, EncodeID is
+// applied to the ID before securecookie signs and encodes it; on New,
+// DecodeID is applied to what securecookie decoded. With InlineThreshold,
+// the transform is also given the values of sessions kept in the cookie.
+type CookieTransform interface {
+	EncodeID(c context.Context, id string) (string, error)
+	DecodeID(c context.Context, value string) (string, error)
+}
+
+// encodeCookieID returns the value of the session cookie carrying id,
+// transformed by transform if it is not nil and encoded with the codecs.
+func encodeCookieID(c context.Context, name, id string, transform CookieTransform,
+	codecs []securecookie.Codec) (string, error) {
+	if transform != nil {
+		var err error
+		if id, err = transform.EncodeID(c, id); err != nil {
+			return "", err
+		}
+	}
+	return securecookie.EncodeMulti(name, id, codecs...)
+}
+
+// decodeCookieID returns the session ID carried by the value of the session
+// cookie, using the codecs followed by transform if it is not nil. If the
+// codecs fail and idFromCookie is set, it is given the raw value instead, and
+// legacy is true.
+func decodeCookieID(c context.Context, name, value string,
+	idFromCookie func(cookieValue string) (string, error),
+	transform CookieTransform, codecs []securecookie.Codec) (id string, legacy bool, err error) {
+	if err := securecookie.DecodeMulti(name, value, &id, codecs...); err != nil {
+		if idFromCookie == nil {
+			return "", false, err
+		}
+		id, err = idFromCookie(value)
+		if err != nil {
+			return "", false, err
+		}
+		if strings.HasPrefix(id, inlinePrefix) {
+			return "", false, errors.New("gaesessions: IDFromCookie returned an inline payload")
+		}
+		return id, true, nil
+	}
+	if transform != nil {
+		id, err = transform.DecodeID(c, id)
+	}
+	return id, false, err
+}
+
+// inlinePrefix starts the cookie payload of a session stored in the cookie
+// itself rather than server-side. Session IDs never start with it.
+const inlinePrefix = "\x00"
+
+// isNotFound reports whether err means that the session referenced by a
+// cookie no longer exists, as opposed to the backing store failing.
+func isNotFound(err error) bool {
+	return err == datastore.ErrNoSuchEntity || err == memcache.ErrCacheMiss ||
+		err == ErrSessionExpired || err == errNoSuchMapSession
+}
+
+// Version returns the version of the stored session that was loaded into
+// session, or the version written by the last Save, and 0 for a session
+// that has not been stored yet. The version is incremented on every save to
+// the datastore, so callers can use it to detect concurrent modifications.
+// Sessions read from memcache by MemcacheDatastoreStore report 0.
+func Version(session *sessions.Session) int64 {
+	if m := peekMeta(session); m != nil {
+		return m.version
+	}
+	return 0
+}
+
+// SessionState tells how New came up with a session.
+type SessionState int
+
+const (
+	// StateNew means the request carried no usable session cookie.
+	StateNew SessionState = iota
+	// StateExpired means the request carried a session cookie but the
+	// session it referenced had expired or been evicted, e.g. so that the
+	// user can be told their session timed out.
+	StateExpired
+	// StateLoaded means the session was loaded from the store.
+	StateLoaded
+)
+
+// State returns the state New left session in. Sessions not returned by one
+// of this package's stores report StateNew.
+func State(session *sessions.Session) SessionState {
+	if m := peekMeta(session); m != nil {
+		return m.state
+	}
+	return StateNew
+}
+
+// setState records how New came up with session.
+func setState(session *sessions.Session, state SessionState) {
+	metaOf(session).state = state
+}
+
+// loadedCookie is the ID and options of a session as New loaded it. See
+// OnlySetCookieOnNewID.
+type loadedCookie struct {
+	id      string
+	options sessions.Options
+}
+
+// markLoaded records that session was loaded from its store.
+func markLoaded(session *sessions.Session) {
+	session.IsNew = false
+	m := metaOf(session)
+	m.state = StateLoaded
+	m.loaded = &loadedCookie{session.ID, *session.Options}
+}
+
+// cookieUnchanged reports whether the cookie Save would set for session is
+// the one the request came with, i.e. the session was loaded and neither
+// its ID nor its options changed since.
+func cookieUnchanged(session *sessions.Session) bool {
+	m := peekMeta(session)
+	return m != nil && m.loaded != nil && m.loaded.id == session.ID &&
+		session.Options != nil && m.loaded.options == *session.Options
+}
+
+// savedSession is the ID, options and digest of the values of a session as
+// the last Save wrote them, so that saving it again unchanged, e.g. from both
+// a handler and Middleware, does not write it twice. Since session objects
+// live for a single request, so does the record.
+type savedSession struct {
+	id      string
+	options sessions.Options
+	digest  []byte
+}
+
+// markSaved records that session was saved as it is now, unless c was made
+// by WithoutCookie, in which case a later Save still has to set the cookie.
+func markSaved(c context.Context, session *sessions.Session, enc blobEncoding) {
+	if skip, _ := c.Value(skipCookieKey{}).(bool); skip {
+		return
+	}
+	digest, err := enc.digest(session.Values)
+	if err != nil {
+		return
+	}
+	metaOf(session).saved = &savedSession{session.ID, *session.Options, digest}
+}
+
+// savedUnchanged reports whether session was already saved as it is now.
+// Values are compared by their encoding, so changes made in place, e.g. to a
+// nested map, are noticed too.
+func savedUnchanged(session *sessions.Session, enc blobEncoding) bool {
+	m := peekMeta(session)
+	if m == nil || m.saved == nil {
+		return false
+	}
+	saved := m.saved
+	if saved.id != session.ID || session.Options == nil || saved.options != *session.Options {
+		return false
+	}
+	digest, err := enc.digest(session.Values)
+	return err == nil && bytes.Equal(digest, saved.digest)
+}
+
+// propertyNameEscaper escapes the characters that would make the name of a
+// "name=value" property ambiguous.
+var propertyNameEscaper = strings.NewReplacer("%", "%25", "=", "%3D")
+
+// property returns the "name=value" form of a label or indexed value. The
+// name is escaped so that the property ends at its first "=", whatever the
+// value contains; names without "%" or "=" are unchanged.
+func property(name, value string) string {
+	return propertyNameEscaper.Replace(name) + "=" + value
+}
+
+// maxIndexedStringLen is the length in bytes of the longest string the
+// datastore accepts in an indexed property.
+const maxIndexedStringLen = 1500
+
+// labelProperties returns labels in the form stored in Session.Labels,
+// leaving out those too long to be indexed, which would make the datastore
+// reject the whole session.
+func labelProperties(labels map[string]string) []string {
+	if len(labels) == 0 {
+		return nil
+	}
+	props := make([]string, 0, len(labels))
+	for name, value := range labels {
+		if p := property(name, value); len(p) <= maxIndexedStringLen {
+			props = append(props, p)
+		}
+	}
+	sort.Strings(props)
+	return props
+}
+
+// indexedProperties returns the values of session.Values under keys in the
+// form stored in Session.Indexed, skipping missing values, values of types
+// that cannot be indexed and values too long to be indexed.
+func indexedProperties(values map[interface{}]interface{}, keys []string) []string {
+	indexed := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if v, ok := indexedValue(values[key]); ok {
+			indexed[key] = v
+		}
+	}
+	return labelProperties(indexed)
+}
+
+// indexedValue formats v for Session.Indexed. Strings, booleans, integers
+// and floats can be indexed.
+func indexedValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), true
+	}
+	return "", false
+}
+
+// blobHash returns the SHA-256 hash of blob, recorded in the metadata of a
+// session loaded from it. See SafeWrite.
+func blobHash(blob []byte) []byte {
+	sum := sha256.Sum256(blob)
+	return sum[:]
+}
+
+// skipCookieKey is the context key set by WithoutCookie.
+type skipCookieKey struct{}
+
+// WithoutCookie returns a copy of c that makes Save store the session without
+// setting its cookie. Use it on endpoints that stream their response, such as
+// server-sent events, where headers cannot be changed after the first flush:
+//
+//	r = r.WithContext(gaesessions.WithoutCookie(r.Context()))
+//
+// The session ID must already be known to the client for later requests to
+// find the session.
+func WithoutCookie(c context.Context) context.Context {
+	return context.WithValue(c, skipCookieKey{}, true)
+}
+
+// SaveWithOptions saves session with its store like session.Save, but with
+// opts in place of session.Options, e.g. to force Secure on one endpoint.
+// The options apply to the cookie and to the stored session's expiration;
+// session.Options and the store's defaults are left unchanged.
+//
+// The save is recorded as if made with session.Options, so that Middleware
+// or a later Save of the unchanged session does not set the cookie again
+// with the original options. Changing the session afterwards saves it with
+// session.Options again.
+func SaveWithOptions(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session, opts *sessions.Options) error {
+	orig := session.Options
+	session.Options = opts
+	err := session.Store().Save(r, w, session)
+	session.Options = orig
+	if err == nil && orig != nil {
+		if m := peekMeta(session); m != nil && m.saved != nil && m.saved.options == *opts {
+			m.saved.options = *orig
+		}
+	}
+	return err
+}
+
+// headerTracker is implemented by response writers that know whether the
+// response headers have been written, such as the one used by Middleware.
+type headerTracker interface {
+	headersWritten() bool
+}
+
+// setCookie adds cookie to the response unless c was made by WithoutCookie.
+// It returns ErrHeadersSent if w reports that the headers were already
+// written, since the cookie would be silently dropped.
+func setCookie(c context.Context, w http.ResponseWriter, cookie *http.Cookie) error {
+	if skip, _ := c.Value(skipCookieKey{}).(bool); skip {
+		return nil
+	}
+	if t, ok := w.(headerTracker); ok && t.headersWritten() {
+		return ErrHeadersSent
+	}
+	http.SetCookie(w, cookie)
+	return nil
+}
+
+// newFromEachCookie calls newSession with a copy of r for each cookie named
+// cookieName that r carries, until one yields a loaded session. Otherwise it
+// returns the result for the first cookie, or for r if there is at most one.
+func newFromEachCookie(r *http.Request, name, cookieName string,
+	newSession func(r *http.Request, name string) (*sessions.Session, error)) (*sessions.Session, error) {
+	var values []string
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == cookieName {
+			values = append(values, cookie.Value)
+		}
+	}
+	if len(values) < 2 {
+		return newSession(r, name)
+	}
+	var first *sessions.Session
+	var firstErr error
+	for i, value := range values {
+		single := r.Clone(r.Context())
+		single.Header = r.Header.Clone()
+		single.Header.Del("Cookie")
+		single.AddCookie(&http.Cookie{Name: cookieName, Value: value})
+		session, err := newSession(single, name)
+		if err == nil && !session.IsNew {
+			return session, nil
+		}
+		if i == 0 {
+			first, firstErr = session, err
+		}
+	}
+	return first, firstErr
+}
+
+// resetSession turns session into a fresh, unsaved session.
+func resetSession(session *sessions.Session) {
+	session.ID = ""
+	session.Values = make(map[interface{}]interface{})
+	session.IsNew = true
+	if m := peekMeta(session); m != nil {
+		*m = sessionMeta{}
+	}
+}
+
+// contextErr returns an error wrapping ErrCanceled and the context's error if
+// c is done, and err otherwise.
+func contextErr(c context.Context, err error) error {
+	if cerr := c.Err(); cerr != nil {
+		return fmt.Errorf("%w: %w", ErrCanceled, cerr)
+	}
+	return err
+}
+
+// The stores must keep satisfying sessions.Store.
+var (
+	_ sessions.Store = (*MemcacheDatastoreStore)(nil)
+	_ sessions.Store = (*DatastoreStore)(nil)
+	_ sessions.Store = (*MemcacheStore)(nil)
+	_ sessions.Store = (*MapStore)(nil)
+)
+
 // MemcacheDatastoreStore -----------------------------------------------------
 
+// DefaultNonPersistentSessionDuration is how long a session saved with a
+// MaxAge of zero, i.e. with a cookie that lasts until the browser is closed,
+// is kept by a store created with a nonPersistentSessionDuration of zero.
 const DefaultNonPersistentSessionDuration = time.Duration(24) * time.Hour
 const defaultKind = "Session"
 
@@ -45,10 +578,7 @@ func NewMemcacheDatastoreStore(kind, keyPrefix string, nonPersistentSessionDurat
 	}
 	return &MemcacheDatastoreStore{
 		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
+		Options: defaultOptions(),
 		kind:   kind,
 		prefix: keyPrefix,
 		nonPersistentSessionDuration: nonPersistentSessionDuration,
@@ -56,14 +586,164 @@ func NewMemcacheDatastoreStore(kind, keyPrefix string, nonPersistentSessionDurat
 }
 
 type MemcacheDatastoreStore struct {
+	// Domain, if set, is copied into the options of every new session.
+	Domain string
+	// Path, if set, is copied into the options of every new session.
+	// Otherwise the path from Options is used, which defaults to "/".
+	Path string
+	// MaxCookieLength is the maximum length of the session cookie's name and
+	// value. Save fails with ErrCookieTooLong rather than set a longer
+	// cookie, which browsers would drop. If 0, 4096 is used; if negative, the
+	// length is not checked.
+	MaxCookieLength int
+	// IDFromCookie, if set, is given the raw value of the session cookie
+	// when the codecs fail to decode it, and returns the session ID. It
+	// allows cookies issued by another session library to keep working
+	// while Save issues cookies of this package.
+	IDFromCookie func(cookieValue string) (string, error)
+	// LegacyCookieName, if set, is the name of a cookie read by New when
+	// the request has no session cookie, e.g. the one set by another
+	// session library. Save only sets the session cookie.
+	LegacyCookieName string
+	// CookieTransform, if set, transforms the session ID inside the cookie,
+	// within the securecookie encoding. Changing it invalidates existing
+	// cookies. It is not applied to IDs returned by IDFromCookie.
+	CookieTransform CookieTransform
+	// CookieNameFunc, if set, returns the name of the cookie carrying the
+	// session with the given name, e.g. to use a fixed "__Host-" prefixed
+	// name whatever the session is called in code.
+	CookieNameFunc func(sessionName string) string
+	// Rand is the source of randomness for new session IDs. If nil,
+	// crypto/rand is used.
+	Rand io.Reader
+	// IDEncoding encodes the random bytes of new session IDs. If nil,
+	// base32.StdEncoding is used; base64.RawURLEncoding gives shorter IDs.
+	// Existing IDs stay valid when it changes.
+	IDEncoding IDEncoding
+	// Serializer encodes session values on save. If nil, GobSerializer is
+	// used. Values written with any registered serializer can be loaded.
+	Serializer Serializer
+	// Compressor, if set, compresses serialized values on save.
+	Compressor Compressor
+	// Transforms are applied in order to the serialized and compressed
+	// values on save, e.g. to encrypt them with an AESGCMTransform. Blobs
+	// are unwrapped on load according to their headers, whatever
+	// combination of steps wrote them, but a blob lacking the envelope of
+	// one of the Transforms is rejected as corrupt: adding a transform
+	// drops the sessions stored without it. Saves and loads fail if a tag
+	// is reserved, see Transform, or used by two of the Transforms.
+	Transforms []Transform
+	// Trace enables OpenCensus spans around datastore and memcache calls.
+	// Spans carry a truncated hash of the session ID, not the ID itself.
+	Trace bool
+	// OnRead, if set, is called by New for every session cookie it
+	// resolves, with source "memcache" or "datastore" naming where the
+	// session was found, or "miss" if it was in neither, e.g. to compute
+	// cache hit ratios. It is not called when loading fails.
+	OnRead func(c context.Context, id, source string)
+	// StaleWhileRevalidate, if positive, makes New refresh the memcache
+	// copy of a session from the datastore when the copy is older than
+	// this, in case it has gone stale, e.g. because a memcache write failed
+	// or the datastore was written directly. The cached copy is still
+	// returned at once; the refresh runs in the background for at most
+	// refreshTimeout, even after the request has been answered, and is
+	// retried by the next read if it is cut short.
+	// Concurrent reads may each start a refresh. The copy is only replaced
+	// if the stored session was saved after it was cached and it has not
+	// changed since the refresh read it, so a refresh never undoes a save,
+	// including one whose AsyncWrite task has not run yet.
+	StaleWhileRevalidate time.Duration
+	// DiscardCorrupt makes New delete session data that cannot be decoded
+	// and return a fresh session instead of ErrCorruptSession.
+	DiscardCorrupt bool
+	// SkipEmptyNewSessions makes Save do nothing for a new session without
+	// values: no ID is generated, nothing is stored and no cookie is set.
+	// It saves work on anonymous and bot traffic.
+	SkipEmptyNewSessions bool
+	// TryAllCookies makes New try every cookie carrying the session name,
+	// using the first that decodes and refers to a stored session, instead
+	// of only the first cookie. It recovers sessions shadowed by a stale
+	// duplicate cookie sent by a buggy client or proxy.
+	TryAllCookies bool
+	// PersistEmpty makes Save store sessions without values, e.g. when an
+	// empty session is a meaningful state. By default such a save writes
+	// nothing and leaves any previously stored values in place. Either way,
+	// a session saved with a negative MaxAge, as on logout, is deleted only
+	// if PersistEmpty is set or it still has values, so clear the values
+	// and set PersistEmpty, or delete the stored session explicitly.
+	PersistEmpty bool
+	// OnlySetCookieOnNewID makes Save set the cookie only if the session is
+	// new, its ID changed or its options changed since it was loaded, to
+	// keep responses small. With a positive MaxAge the cookie's expiry in
+	// the browser is then no longer pushed back by every save.
+	OnlySetCookieOnNewID bool
+	// AsyncWrite hands datastore writes to a task queue task instead of
+	// making them during Save. Save then returns as soon as the task is
+	// enqueued, but a write can be delayed or, if the task keeps failing,
+	// lost, and a request that follows immediately may load the previous
+	// values. Use it only for sessions that can tolerate that. If the task
+	// cannot be enqueued after a few attempts, the write is made directly.
+	AsyncWrite bool
+	// TaskHook, if set, is called with each AsyncWrite task and the session
+	// ID before the task is added to the default queue, to adjust e.g. its
+	// headers or RetryOptions. Its Path and Payload must not be changed.
+	// Task names cannot be reused, even for some time after the task has
+	// run: if a task with the name exists, Save fails with
+	// taskqueue.ErrTaskAlreadyAdded without writing to the datastore, so a
+	// name must be unique to each save.
+	TaskHook func(t *taskqueue.Task, id string)
+	// WriteTaskPath, if set, makes AsyncWrite tasks POST to this path, where
+	// WriteTaskHandler must be mounted, instead of relying on the delay
+	// package, which the second-generation runtimes lack.
+	WriteTaskPath string
+	// ExpirationGracePeriod is added to a stored session's expiration date
+	// before deciding on load that it has expired, to absorb clock skew
+	// between the instance that saved it and the one reading it.
+	ExpirationGracePeriod time.Duration
+	// LabelFunc, if set, returns labels stored with the session on Save,
+	// e.g. {"channel": "mobile"}, for segmenting sessions in queries. See
+	// Session.Labels. Labels longer than 1500 bytes in their "name=value"
+	// form cannot be indexed and are left out.
+	LabelFunc func(r *http.Request) map[string]string
+	// KindFunc, if set, returns the kind used to store the session for a
+	// request. An empty result falls back to the store's kind.
+	KindFunc func(r *http.Request) string
+
 	Codecs                       []securecookie.Codec
 	Options                      *sessions.Options // default configuration
+	mu                           sync.RWMutex      // guards Codecs
 	kind                         string
 	prefix                       string
 	nonPersistentSessionDuration time.Duration
 }
 
-// Get returns a session for the given name after adding it to the registry.
+// RotateKeys atomically replaces the store's codecs with ones built from
+// keyPairs. Use it instead of assigning Codecs while requests are in flight.
+//
+// See NewCookieStore() for a description of keyPairs.
+func (s *MemcacheDatastoreStore) RotateKeys(keyPairs ...[]byte) {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	s.mu.Lock()
+	s.Codecs = codecs
+	s.mu.Unlock()
+}
+
+// codecs returns the current codecs.
+func (s *MemcacheDatastoreStore) codecs() []securecookie.Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Codecs
+}
+
+// encoding returns the encoding used for stored session values.
+func (s *MemcacheDatastoreStore) encoding() blobEncoding {
+	return blobEncoding{s.Serializer, s.Compressor, s.Transforms}
+}
+
+// Get returns a session for the given name after adding it to the registry,
+// which makes sessions.Save and Middleware save it. For a read-only check,
+// call New instead: it returns a session that is neither registered nor
+// shared with other Get calls of the request.
 //
 // See CookieStore.Get().
 func (s *MemcacheDatastoreStore) Get(r *http.Request, name string) (
@@ -76,218 +756,1958 @@ func (s *MemcacheDatastoreStore) Get(r *http.Request, name string) (
 // See CookieStore.New().
 func (s *MemcacheDatastoreStore) New(r *http.Request, name string) (*sessions.Session,
 	error) {
-	session := sessions.NewSession(s, name)
+	if s.TryAllCookies {
+		return newFromEachCookie(r, name, cookieName(s.CookieNameFunc, name), s.newSession)
+	}
+	return s.newSession(r, name)
+}
+
+// newSession implements New for the first cookie with the given name.
+func (s *MemcacheDatastoreStore) newSession(r *http.Request, name string) (*sessions.Session,
+	error) {
+	session := newSession(s, name)
 	opts := *s.Options
+	if s.Domain != "" {
+		opts.Domain = s.Domain
+	}
+	if s.Path != "" {
+		opts.Path = s.Path
+	}
 	session.Options = &opts
 	session.IsNew = true
-	var err error
-	if cookie, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, cookie.Value, &session.ID,
-			s.Codecs...)
-		if err == nil {
-			c := appengine.NewContext(r)
-			err = loadFromMemcache(c, session)
-			if err == memcache.ErrCacheMiss {
-				err = loadFromDatastore(c, s.kind, session)
+	if cookie, errCookie := requestCookie(r, cookieName(s.CookieNameFunc, name), s.LegacyCookieName); errCookie == nil {
+		id, _, err := decodeCookieID(appengine.NewContext(r), cookie.Name, cookie.Value, s.IDFromCookie, s.CookieTransform, s.codecs())
+		if err != nil {
+			return session, fmt.Errorf("%w: %w", ErrCookieDecode, err)
+		}
+		session.ID = id
+		c := appengine.NewContext(r)
+		mc, span := startSpan(c, s.Trace, "memcache.load", session.ID)
+		cachedAt, err := loadFromMemcache(mc, appEngineCache{}, s.encoding(), session)
+		span.end(err)
+		source := "memcache"
+		if err == nil && s.StaleWhileRevalidate > 0 && time.Since(cachedAt) > s.StaleWhileRevalidate {
+			go s.refresh(c, s.kindFor(r), session.ID)
+		}
+		if err != nil && errors.Is(err, ErrCorruptSession) {
+			// The cached copy may have been written in a format this
+			// instance cannot read; the datastore has the authoritative one.
+			logger(c).Warningf(c, "gaesessions: ignoring cached session %s: %v", session.ID, err)
+			err = memcache.ErrCacheMiss
+		}
+		if err == memcache.ErrCacheMiss {
+			dc, span := startSpan(c, s.Trace, "datastore.load", session.ID)
+			err = loadFromDatastore(dc, s.kindFor(r), false, s.encoding(), s.ExpirationGracePeriod, 0, session)
+			span.end(err)
+			source = "datastore"
+		}
+		if isNotFound(err) {
+			source = "miss"
+		}
+		if s.OnRead != nil && (err == nil || source == "miss") {
+			s.OnRead(c, session.ID, source)
+		}
+		if err != nil && s.DiscardCorrupt && errors.Is(err, ErrCorruptSession) {
+			logger(c).Warningf(c, "gaesessions: discarding session %s: %v", session.ID, err)
+			addOps(c, opMemcache, 1)
+			if err := memcache.Delete(c, session.ID); err != nil && err != memcache.ErrCacheMiss {
+				return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
 			}
-			if err == nil {
-				session.IsNew = false
+			k := sessionKey(c, s.kindFor(r), session.ID, false)
+			addOps(c, opDatastoreWrite, 1)
+			if err := datastore.Delete(c, k); err != nil {
+				return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
 			}
+			resetSession(session)
+			return session, nil
+		}
+		if isNotFound(err) {
+			resetSession(session)
+			setState(session, StateExpired)
+			return session, nil
 		}
+		if err != nil {
+			return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+		}
+		markLoaded(session)
 	}
-	return session, err
+	return session, nil
 }
 
 // Save adds a single session to the response.
 func (s *MemcacheDatastoreStore) Save(r *http.Request, w http.ResponseWriter,
 	session *sessions.Session) error {
+	defer releaseMeta(session)
+	if s.SkipEmptyNewSessions && session.IsNew && len(session.Values) == 0 {
+		return nil
+	}
+	if savedUnchanged(session, s.encoding()) {
+		return nil
+	}
 	if session.ID == "" {
-		session.ID = s.prefix +
-			strings.TrimRight(
-				base32.StdEncoding.EncodeToString(
-					securecookie.GenerateRandomKey(32)), "=")
+		id, err := newSessionID(s.Rand, s.IDEncoding)
+		if err != nil {
+			return err
+		}
+		session.ID = s.prefix + id
+	}
+	if s.LabelFunc != nil {
+		metaOf(session).labels = s.LabelFunc(r)
+	}
+	if m := metaOf(session); m.created.IsZero() && session.IsNew {
+		// Set here rather than by saveToDatastore, so that the cached copy
+		// carries it too.
+		m.created = time.Now()
 	}
 	c := appengine.NewContext(r)
-	if err := saveToMemcache(c, s.nonPersistentSessionDuration, session); err != nil {
+	mc, span := startSpan(c, s.Trace, "memcache.save", session.ID)
+	err := saveToMemcache(mc, appEngineCache{}, s.encoding(), s.nonPersistentSessionDuration, false, false, s.PersistEmpty, session)
+	span.end(err)
+	if err != nil {
 		return err
 	}
-	if err := saveToDatastore(c, s.kind, s.nonPersistentSessionDuration, session); err != nil {
+	dc, span := startSpan(c, s.Trace, "datastore.save", session.ID)
+	_, err = saveToDatastore(dc, s.kindFor(r), false, s.encoding(), s.nonPersistentSessionDuration, s.AsyncWrite, s.TaskHook, s.WriteTaskPath, false, false, false, s.PersistEmpty, session)
+	span.end(err)
+	if err != nil {
 		return err
 	}
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
+	if s.OnlySetCookieOnNewID && cookieUnchanged(session) {
+		markSaved(c, session, s.encoding())
+		return nil
+	}
+	name := cookieName(s.CookieNameFunc, session.Name())
+	encoded, err := encodeCookieID(c, name, session.ID, s.CookieTransform, s.codecs())
 	if err != nil {
 		return err
 	}
-	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded,
-		session.Options))
+	cookie := sessions.NewCookie(name, encoded, session.Options)
+	if err := checkCookiePrefix(cookie); err != nil {
+		return err
+	}
+	if err := checkCookieLength(cookie, s.MaxCookieLength); err != nil {
+		return err
+	}
+	if err := setCookie(c, w, cookie); err != nil {
+		return err
+	}
+	markSaved(c, session, s.encoding())
 	return nil
 }
 
-// DatastoreStore -------------------------------------------------------------
-
-// Session is used to load and save session data in the datastore.
-type Session struct {
-	Date           time.Time
-	ExpirationDate time.Time
-	Value          []byte
+// Touch extends the expiration of the session with the given ID in both the
+// datastore and memcache as if it had just been saved with the store's
+// default options, without writing a cookie. It returns ErrSessionExpired
+// for a session that has expired but not been cleaned up yet.
+//
+// See DatastoreStore.Touch().
+func (s *MemcacheDatastoreStore) Touch(c context.Context, id string) error {
+	expiration := sessionExpiration(s.Options, s.nonPersistentSessionDuration)
+	entity, err := touchDatastore(c, s.kind, id, false, s.ExpirationGracePeriod, 0, expiration)
+	if err != nil || entity == nil {
+		return err
+	}
+	addOps(c, opMemcache, 1)
+	err = memcache.Set(c, &memcache.Item{
+		Key:        id,
+		Value:      withCreated(entity.Created, entity.Value),
+		Flags:      cachedAtFlags(),
+		Expiration: expiration,
+	})
+	if err != nil {
+		return contextErr(c, err)
+	}
+	return nil
 }
 
-// NewDatastoreStore returns a new DatastoreStore.
-//
-// The kind argument is the kind name used to store the session data.
-// If empty it will use "Session".
+// Expire deletes the session with the given ID from both memcache and the
+// datastore whatever its expiration date, e.g. to revoke it. It succeeds if
+// the session is already gone. KindFunc is not consulted.
 //
-// See NewCookieStore() for a description of the other parameters.
-func NewDatastoreStore(kind string, nonPersistentSessionDuration time.Duration, keyPairs ...[]byte) *DatastoreStore {
-	if kind == "" {
-		kind = "Session"
+// See DatastoreStore.Expire().
+func (s *MemcacheDatastoreStore) Expire(c context.Context, id string) error {
+	if err := contextErr(c, nil); err != nil {
+		return err
 	}
-	return &DatastoreStore{
-		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
-		kind: kind,
-		nonPersistentSessionDuration: nonPersistentSessionDuration,
+	addOps(c, opMemcache, 1)
+	if err := memcache.Delete(c, id); err != nil && err != memcache.ErrCacheMiss {
+		return contextErr(c, err)
+	}
+	addOps(c, opDatastoreWrite, 1)
+	if err := datastore.Delete(c, sessionKey(c, s.kind, id, false)); err != nil {
+		return contextErr(c, err)
+	}
+	return nil
+}
+
+// Exists reports whether a session with the given ID is cached or stored
+// unexpired in the datastore.
+func (s *MemcacheDatastoreStore) Exists(c context.Context, id string) (bool, error) {
+	ok, err := existsInMemcache(c, appEngineCache{}, id)
+	if ok || err != nil {
+		return ok, err
+	}
+	return existsInDatastore(c, s.kind, id, false, s.ExpirationGracePeriod)
+}
+
+// refreshTimeout bounds a background refresh for StaleWhileRevalidate.
+const refreshTimeout = 10 * time.Second
+
+// refresh replaces the cached copy of the session with the given ID by the
+// one stored under kind, if that was saved after the copy was cached. It is
+// run in the background for StaleWhileRevalidate, so it only logs failures.
+// c is the context of the request, which is cancelled once the request has
+// been answered; refresh detaches from it and gives up after
+// refreshTimeout instead. The copy is swapped with CompareAndSwap, so that a
+// copy cached by a save in the meantime is kept.
+func (s *MemcacheDatastoreStore) refresh(c context.Context, kind, id string) {
+	c, cancel := context.WithTimeout(detachedContext{c}, refreshTimeout)
+	defer cancel()
+	if err := revalidateMemcache(c, kind, id); err != nil {
+		logger(c).Warningf(c, "gaesessions: refreshing cached session %s: %v", id, err)
+	}
+}
+
+// detachedContext carries the values of its parent, e.g. the logger and the
+// App Engine API state, but is never cancelled with it, like
+// context.WithoutCancel in Go 1.21.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
+
+// revalidateMemcache does the work of refresh.
+func revalidateMemcache(c context.Context, kind, id string) error {
+	addOps(c, opMemcache, 1)
+	item, err := memcache.Get(c, id)
+	if err == memcache.ErrCacheMiss {
+		// The next read falls through to the datastore anyway.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entity Session
+	addOps(c, opDatastoreRead, 1)
+	err = datastore.Get(c, sessionKey(c, kind, id, false), &entity)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// Stores write memcache before the datastore, so a stored session that
+	// is older than the copy has yet to catch up with it.
+	if expired(entity.ExpirationDate, 0) || entity.Date.Unix() < int64(item.Flags) {
+		return nil
+	}
+	item.Value = withCreated(entity.Created, entity.Value)
+	item.Flags = cachedAtFlags()
+	item.Expiration = time.Until(entity.ExpirationDate)
+	addOps(c, opMemcache, 1)
+	err = memcache.CompareAndSwap(c, item)
+	if err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+		return nil
+	}
+	return err
+}
+
+// Warm copies the stored sessions with the given IDs from the datastore to
+// memcache in batches, e.g. for recently active sessions after memcache was
+// flushed, so that their next reads do not all fall through to the
+// datastore. Missing sessions are skipped, and so are expired ones, allowing
+// for ExpirationGracePeriod. KindFunc is not consulted; the store's kind is
+// used.
+func (s *MemcacheDatastoreStore) Warm(c context.Context, ids ...string) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxGetMultiKeys {
+			n = maxGetMultiKeys
+		}
+		if err := s.warm(c, ids[:n]); err != nil {
+			return err
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// maxGetMultiKeys is the largest number of keys datastore.GetMulti accepts.
+const maxGetMultiKeys = 1000
+
+// warm copies a batch of at most maxGetMultiKeys sessions to memcache.
+func (s *MemcacheDatastoreStore) warm(c context.Context, ids []string) error {
+	if err := contextErr(c, nil); err != nil {
+		return err
+	}
+	keys := make([]*datastore.Key, len(ids))
+	for i, id := range ids {
+		keys[i] = sessionKey(c, s.kind, id, false)
+	}
+	entities := make([]Session, len(ids))
+	addOps(c, opDatastoreRead, len(keys))
+	err := datastore.GetMulti(c, keys, entities)
+	merr, _ := err.(appengine.MultiError)
+	if err != nil && merr == nil {
+		return contextErr(c, err)
+	}
+	items := make([]*memcache.Item, 0, len(ids))
+	for i, entity := range entities {
+		if merr != nil && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return contextErr(c, merr[i])
+		}
+		if item := warmItem(ids[i], entity, s.ExpirationGracePeriod); item != nil {
+			items = append(items, item)
+		}
+	}
+	if len(items) == 0 {
+		return nil
+	}
+	addOps(c, opMemcache, len(items))
+	if err := memcache.SetMulti(c, items); err != nil {
+		return contextErr(c, err)
+	}
+	return nil
+}
+
+// warmItem returns the memcache item for the stored session with the given
+// ID, expiring when New would stop loading it from the datastore, or nil if
+// it has expired, allowing for grace. Memcache counts expirations in whole
+// seconds and reads 0 as never, so a session with less than a second left is
+// skipped too.
+func warmItem(id string, entity Session, grace time.Duration) *memcache.Item {
+	if expired(entity.ExpirationDate, grace) {
+		return nil
+	}
+	expiration := time.Until(entity.ExpirationDate.Add(grace))
+	if expiration < time.Second {
+		return nil
+	}
+	return &memcache.Item{
+		Key:        id,
+		Value:      withCreated(entity.Created, entity.Value),
+		Flags:      cachedAtFlags(),
+		Expiration: expiration,
+	}
+}
+
+// Key returns the datastore key of the entity holding session, for use in
+// queries or transactions involving it. It is nil if session has not been
+// saved yet. The store's kind is used; with KindFunc, the key of the session
+// under another kind has the same ID.
+func (s *MemcacheDatastoreStore) Key(c context.Context, session *sessions.Session) *datastore.Key {
+	if session.ID == "" {
+		return nil
+	}
+	return sessionKey(c, s.kind, session.ID, false)
+}
+
+// kindFor returns the kind used to store sessions for r.
+func (s *MemcacheDatastoreStore) kindFor(r *http.Request) string {
+	if s.KindFunc != nil {
+		if kind := s.KindFunc(r); kind != "" {
+			return kind
+		}
+	}
+	return s.kind
+}
+
+// DatastoreStore -------------------------------------------------------------
+
+// Session is used to load and save session data in the datastore.
+//
+// Only Date, Created, ExpirationDate, Labels and Indexed are indexed, since
+// they are the only properties queried (by DatastoreStore.PurgeOlderThan,
+// RemoveExpiredDatastoreSessions, DatastoreStore.RemoveExpiredLabeled and
+// DatastoreStore.Query).
+type Session struct {
+	// Date is when the session was last saved.
+	Date time.Time
+	// Created is when the session was first saved. Sessions stored before
+	// it was introduced get their Date on their next save.
+	// MemcacheDatastoreStore keeps it in its memcache items too; a session
+	// loaded from an item cached before that has its stored Created read
+	// back when it is saved.
+	Created        time.Time
+	ExpirationDate time.Time
+	Value          []byte `datastore:",noindex"`
+	// Version is incremented every time the session is saved.
+	Version int64 `datastore:",noindex"`
+	// Labels holds the labels returned by the store's LabelFunc, each as
+	// "name=value" with "%" and "=" in the name escaped as in URLs, sorted.
+	Labels []string
+	// Indexed holds the session values projected by the store's
+	// IndexedKeys, each as "key=value" escaped like Labels, sorted.
+	Indexed []string
+}
+
+// NewDatastoreStore returns a new DatastoreStore.
+//
+// The kind argument is the kind name used to store the session data.
+// If empty it will use "Session".
+//
+// See NewCookieStore() for a description of the other parameters.
+func NewDatastoreStore(kind string, nonPersistentSessionDuration time.Duration, keyPairs ...[]byte) *DatastoreStore {
+	if kind == "" {
+		kind = "Session"
+	}
+	return &DatastoreStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: defaultOptions(),
+		kind: kind,
+		nonPersistentSessionDuration: nonPersistentSessionDuration,
+	}
+}
+
+// DatastoreStore stores sessions in the App Engine datastore.
+type DatastoreStore struct {
+	// Domain, if set, is copied into the options of every new session.
+	Domain string
+	// Path, if set, is copied into the options of every new session.
+	// Otherwise the path from Options is used, which defaults to "/".
+	Path string
+	// MaxCookieLength is the maximum length of the session cookie's name and
+	// value. Save fails with ErrCookieTooLong rather than set a longer
+	// cookie, which browsers would drop. If 0, 4096 is used; if negative, the
+	// length is not checked.
+	MaxCookieLength int
+	// IDFromCookie, if set, is given the raw value of the session cookie
+	// when the codecs fail to decode it, and returns the session ID. It
+	// allows cookies issued by another session library to keep working
+	// while Save issues cookies of this package.
+	IDFromCookie func(cookieValue string) (string, error)
+	// LegacyCookieName, if set, is the name of a cookie read by New when
+	// the request has no session cookie, e.g. the one set by another
+	// session library. Save only sets the session cookie.
+	LegacyCookieName string
+	// CookieTransform, if set, transforms the session ID inside the cookie,
+	// within the securecookie encoding. Changing it invalidates existing
+	// cookies. It is not applied to IDs returned by IDFromCookie.
+	CookieTransform CookieTransform
+	// CookieNameFunc, if set, returns the name of the cookie carrying the
+	// session with the given name, e.g. to use a fixed "__Host-" prefixed
+	// name whatever the session is called in code.
+	CookieNameFunc func(sessionName string) string
+	// Rand is the source of randomness for new session IDs. If nil,
+	// crypto/rand is used.
+	Rand io.Reader
+	// IDEncoding encodes the random bytes of new session IDs. If nil,
+	// base32.StdEncoding is used; base64.RawURLEncoding gives shorter IDs.
+	// Existing IDs stay valid when it changes.
+	IDEncoding IDEncoding
+	// Serializer encodes session values on save. If nil, GobSerializer is
+	// used. Values written with any registered serializer can be loaded.
+	Serializer Serializer
+	// Compressor, if set, compresses serialized values on save.
+	Compressor Compressor
+	// Transforms are applied in order to the serialized and compressed
+	// values on save, e.g. to encrypt them with an AESGCMTransform. Blobs
+	// are unwrapped on load according to their headers, whatever
+	// combination of steps wrote them, but a blob lacking the envelope of
+	// one of the Transforms is rejected as corrupt: adding a transform
+	// drops the sessions stored without it. Saves and loads fail if a tag
+	// is reserved, see Transform, or used by two of the Transforms.
+	Transforms []Transform
+	// Trace enables OpenCensus spans around datastore and memcache calls.
+	// Spans carry a truncated hash of the session ID, not the ID itself.
+	Trace bool
+	// DiscardCorrupt makes New delete session data that cannot be decoded
+	// and return a fresh session instead of ErrCorruptSession.
+	DiscardCorrupt bool
+	// SkipEmptyNewSessions makes Save do nothing for a new session without
+	// values: no ID is generated, nothing is stored and no cookie is set.
+	// It saves work on anonymous and bot traffic.
+	SkipEmptyNewSessions bool
+	// TryAllCookies makes New try every cookie carrying the session name,
+	// using the first that decodes and refers to a stored session, instead
+	// of only the first cookie. It recovers sessions shadowed by a stale
+	// duplicate cookie sent by a buggy client or proxy.
+	TryAllCookies bool
+	// PersistEmpty makes Save store sessions without values, e.g. when an
+	// empty session is a meaningful state. By default such a save writes
+	// nothing and leaves any previously stored values in place. Either way,
+	// a session saved with a negative MaxAge, as on logout, is deleted only
+	// if PersistEmpty is set or it still has values, so clear the values
+	// and set PersistEmpty, or delete the stored session explicitly.
+	PersistEmpty bool
+	// OnlySetCookieOnNewID makes Save set the cookie only if the session is
+	// new, its ID changed or its options changed since it was loaded, to
+	// keep responses small. With a positive MaxAge the cookie's expiry in
+	// the browser is then no longer pushed back by every save.
+	OnlySetCookieOnNewID bool
+	// AsyncWrite hands datastore writes to a task queue task instead of
+	// making them during Save. Save then returns as soon as the task is
+	// enqueued, but a write can be delayed or, if the task keeps failing,
+	// lost, and a request that follows immediately may load the previous
+	// values. Use it only for sessions that can tolerate that. If the task
+	// cannot be enqueued after a few attempts, the write is made directly.
+	AsyncWrite bool
+	// TaskHook, if set, is called with each AsyncWrite task and the session
+	// ID before the task is added to the default queue, to adjust e.g. its
+	// headers or RetryOptions. Its Path and Payload must not be changed.
+	// Task names cannot be reused, even for some time after the task has
+	// run: if a task with the name exists, Save fails with
+	// taskqueue.ErrTaskAlreadyAdded without writing to the datastore, so a
+	// name must be unique to each save.
+	TaskHook func(t *taskqueue.Task, id string)
+	// WriteTaskPath, if set, makes AsyncWrite tasks POST to this path, where
+	// WriteTaskHandler must be mounted, instead of relying on the delay
+	// package, which the second-generation runtimes lack.
+	WriteTaskPath string
+	// BatchTasks makes Middleware collect the AsyncWrite tasks of each
+	// request and add them to the queue together once its sessions are
+	// saved, see WithTaskBatch, sparing an RPC per save. Save errors about
+	// the tasks are then reported when they are added, after the cookie has
+	// been set.
+	BatchTasks bool
+	// ExpirationGracePeriod is added to a stored session's expiration date
+	// before deciding on load that it has expired, to absorb clock skew
+	// between the instance that saved it and the one reading it.
+	ExpirationGracePeriod time.Duration
+	// OptimisticLocking makes Save fail with ErrVersionConflict if the
+	// stored session was saved by another request since it was loaded. The
+	// check and the write run in a transaction. See Version.
+	OptimisticLocking bool
+	// SafeWrite makes Save fail with ErrConcurrentModification if the
+	// stored session data differs from what was loaded, comparing hashes of
+	// the stored blobs. Unlike OptimisticLocking it also catches writes by
+	// code that does not maintain versions. The check and the write run in
+	// a transaction, and such saves are made directly even if AsyncWrite is
+	// set.
+	SafeWrite bool
+	// CleanupTimeout bounds how long a request to CleanupHandler keeps
+	// deleting. If 0, one minute is used.
+	CleanupTimeout time.Duration
+	// CleanupBatchSize is the number of sessions CleanupHandler deletes per
+	// datastore call. If 0, or above the datastore's limit of 500 entities
+	// per call, 500 is used. Smaller batches report progress and notice a
+	// timeout sooner.
+	CleanupBatchSize int
+	// RotateOnEverySave makes Save store a previously saved session under a
+	// new ID every time and set a cookie with it, so that a captured cookie
+	// soon stops working. The session under the old ID is kept for
+	// RotationGracePeriod (plus ExpirationGracePeriod) so that requests
+	// already in flight with the old cookie still find it, with the values
+	// it had before the save. Deleting a session does not rotate it.
+	// Rotations are written directly even with AsyncWrite. If the old ID
+	// cannot be cut short, the failure is logged and it keeps working until
+	// it expires.
+	RotateOnEverySave bool
+	// RotationGracePeriod is how long the old ID keeps working after a
+	// rotation. If 0, ten seconds is used.
+	RotationGracePeriod time.Duration
+	// CheckIDCollision makes Save write a session under a newly generated
+	// ID in a transaction that fails if a session is already stored under
+	// it, and retry with another ID, rather than overwrite an unrelated
+	// session. Random IDs practically never collide, so this only guards
+	// against a broken Rand, at the cost of a read per new session. Such
+	// writes are made directly even if AsyncWrite is set.
+	CheckIDCollision bool
+	// OnExpire, if set, is called by RemoveExpired and CleanupHandler for
+	// every expired session they delete, e.g. to keep an audit trail of
+	// terminated sessions. Setting it makes cleanup read whole entities
+	// instead of keys only.
+	OnExpire ExpireFunc
+	// SizeHistogram enables recording the serialized size of every saved
+	// session. See SizeStats.
+	SizeHistogram bool
+	// NumericIDs makes Save allocate the IDs of new sessions with
+	// datastore.AllocateIDs and store them under integer keys, which are
+	// smaller than the default random key names, at the cost of an extra
+	// RPC per new session. The cookie carries the decimal ID. The IDs are
+	// guessable, so the session cookie must be authenticated by the codecs;
+	// do not combine it with IDFromCookie, whose decimal IDs would then map
+	// to integer keys too.
+	NumericIDs bool
+	// ShardCount, if greater than 1, spreads sessions over that many kinds,
+	// named after the store's kind with "_0", "_1", ... appended, picking
+	// the kind by hashing the session ID, to spread writes at very high
+	// volumes. Lookups still read a single entity, but cleanup queries every
+	// shard in turn. Changing it makes existing sessions unreachable.
+	ShardCount int
+	// SaveErrorFunc, if set, is called by Middleware when saving the
+	// request's sessions fails.
+	SaveErrorFunc func(r *http.Request, err error)
+	// LabelFunc, if set, returns labels stored with the session on Save,
+	// e.g. {"channel": "mobile"}, for segmenting sessions in queries. See
+	// Session.Labels. Labels longer than 1500 bytes in their "name=value"
+	// form cannot be indexed and are left out.
+	LabelFunc func(r *http.Request) map[string]string
+	// KindFunc, if set, returns the kind used to store the session for a
+	// request. An empty result falls back to the store's kind.
+	KindFunc func(r *http.Request) string
+	// IndexedKeys lists keys of session.Values whose values are also
+	// stored in Session.Indexed on Save, so that sessions can be found with
+	// Query without decoding every blob. Only string, bool, int, int64 and
+	// float64 values are indexed; other values, and values longer than 1500
+	// bytes in their "key=value" form, are left out.
+	IndexedKeys []string
+	// InlineThreshold, if positive, makes Save store a session whose stored
+	// blob would be shorter than it in the session cookie instead of the
+	// datastore, sparing the datastore write and, on the next request, the
+	// read. Such a session has an empty ID. Once a session has grown past
+	// the threshold and been stored, it stays in the datastore. Keep the
+	// threshold well below MaxCookieLength, as the cookie encoding adds a
+	// third and more.
+	//
+	// The securecookie codecs only sign the cookie unless they were created
+	// with encryption keys, so without those or an AESGCMTransform in
+	// Transforms the client can read inline values. Inline sessions cannot
+	// be revoked server-side either: Expire has nothing to delete, and an old
+	// cookie keeps loading its values until the codecs reject it as older
+	// than their MaxAge, 30 days by default, whatever was saved since.
+	InlineThreshold int
+	// LegacyCompat makes New load sessions stored without an expiration
+	// date, such as those written by the original gorilla gaesessions,
+	// which only stores Date and Value. Such a session expires the store's
+	// MaxAge (or nonPersistentSessionDuration) after its Date; without
+	// LegacyCompat it is treated as expired. Saving the session adds the
+	// expiration date. Legacy sessions that are never saved again are not
+	// found by RemoveExpired, which queries by expiration date.
+	LegacyCompat bool
+
+	Codecs                       []securecookie.Codec
+	Options                      *sessions.Options // default configuration
+	mu                           sync.RWMutex      // guards Codecs
+	kind                         string
+	nonPersistentSessionDuration time.Duration
+	sizes                        sizeHistogram
+}
+
+// RotateKeys atomically replaces the store's codecs with ones built from
+// keyPairs. Use it instead of assigning Codecs while requests are in flight.
+//
+// See NewCookieStore() for a description of keyPairs.
+func (s *DatastoreStore) RotateKeys(keyPairs ...[]byte) {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	s.mu.Lock()
+	s.Codecs = codecs
+	s.mu.Unlock()
+}
+
+// codecs returns the current codecs.
+func (s *DatastoreStore) codecs() []securecookie.Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Codecs
+}
+
+// encoding returns the encoding used for stored session values.
+func (s *DatastoreStore) encoding() blobEncoding {
+	return blobEncoding{s.Serializer, s.Compressor, s.Transforms}
+}
+
+// Get returns a session for the given name after adding it to the registry,
+// which makes sessions.Save and Middleware save it. For a read-only check,
+// call New instead: it returns a session that is neither registered nor
+// shared with other Get calls of the request.
+//
+// See CookieStore.Get().
+func (s *DatastoreStore) Get(r *http.Request, name string) (*sessions.Session,
+	error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// See CookieStore.New().
+func (s *DatastoreStore) New(r *http.Request, name string) (*sessions.Session,
+	error) {
+	if s.TryAllCookies {
+		return newFromEachCookie(r, name, cookieName(s.CookieNameFunc, name), s.newSession)
+	}
+	return s.newSession(r, name)
+}
+
+// newSession implements New for the first cookie with the given name.
+func (s *DatastoreStore) newSession(r *http.Request, name string) (*sessions.Session,
+	error) {
+	session := newSession(s, name)
+	opts := *s.Options
+	if s.Domain != "" {
+		opts.Domain = s.Domain
+	}
+	if s.Path != "" {
+		opts.Path = s.Path
+	}
+	session.Options = &opts
+	session.IsNew = true
+	if cookie, errCookie := requestCookie(r, cookieName(s.CookieNameFunc, name), s.LegacyCookieName); errCookie == nil {
+		id, _, err := decodeCookieID(appengine.NewContext(r), cookie.Name, cookie.Value, s.IDFromCookie, s.CookieTransform, s.codecs())
+		if err != nil {
+			return session, fmt.Errorf("%w: %w", ErrCookieDecode, err)
+		}
+		c, kind := appengine.NewContext(r), s.kindFor(r)
+		if strings.HasPrefix(id, inlinePrefix) {
+			err := s.encoding().decode(session.ID, []byte(id[len(inlinePrefix):]), &session.Values)
+			if err != nil && s.DiscardCorrupt && errors.Is(err, ErrCorruptSession) {
+				logger(c).Warningf(c, "gaesessions: discarding inline session: %v", err)
+				resetSession(session)
+				return session, nil
+			}
+			if err != nil {
+				return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+			}
+			markLoaded(session)
+			return session, nil
+		}
+		session.ID = id
+		err = s.load(c, kind, session)
+		if err != nil && s.DiscardCorrupt && errors.Is(err, ErrCorruptSession) {
+			logger(c).Warningf(c, "gaesessions: discarding session %s: %v", session.ID, err)
+			k := sessionKey(c, s.shardKind(kind, session.ID), session.ID, s.NumericIDs)
+			addOps(c, opDatastoreWrite, 1)
+			if err := datastore.Delete(c, k); err != nil {
+				return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+			}
+			resetSession(session)
+			return session, nil
+		}
+		if isNotFound(err) {
+			resetSession(session)
+			setState(session, StateExpired)
+			return session, nil
+		}
+		if err != nil {
+			return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+		}
+		markLoaded(session)
+	}
+	return session, nil
+}
+
+// Save adds a single session to the response.
+func (s *DatastoreStore) Save(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	_, err := s.SaveWithSize(r, w, session)
+	return err
+}
+
+// SaveWithSize is like Save but also returns the number of serialized bytes
+// written to the datastore. It returns 0 if nothing was written or the
+// session was deleted.
+func (s *DatastoreStore) SaveWithSize(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) (int, error) {
+	result, err := s.SaveWithResult(r, w, session)
+	return result.Size, err
+}
+
+// SaveResult describes what a save wrote to the datastore.
+type SaveResult struct {
+	// Size is the number of serialized bytes written. It is 0 if nothing
+	// was written or the session was deleted.
+	Size int
+	// Created reports whether a new session was stored, as opposed to an
+	// existing one being updated. It is true when a session with IsNew set
+	// is written.
+	Created bool
+}
+
+// SaveWithResult is like Save but also reports what was written.
+func (s *DatastoreStore) SaveWithResult(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) (SaveResult, error) {
+	defer releaseMeta(session)
+	if s.LabelFunc != nil {
+		metaOf(session).labels = s.LabelFunc(r)
+	}
+	size, err := s.save(appengine.NewContext(r), s.kindFor(r), w, session)
+	if err != nil {
+		return SaveResult{}, err
+	}
+	return SaveResult{Size: size, Created: session.IsNew && size > 0}, nil
+}
+
+// SaveCtx is like Save but uses the given context instead of deriving one
+// from a request. KindFunc is not consulted; the store's kind is used.
+func (s *DatastoreStore) SaveCtx(c context.Context, w http.ResponseWriter,
+	session *sessions.Session) error {
+	defer releaseMeta(session)
+	_, err := s.save(c, s.kind, w, session)
+	return err
+}
+
+// LoadCtx loads the values of the session with ID session.ID into
+// session.Values using the given context. KindFunc is not consulted; the
+// store's kind is used.
+func (s *DatastoreStore) LoadCtx(c context.Context,
+	session *sessions.Session) error {
+	return s.load(c, s.kind, session)
+}
+
+// GetByID loads the session with the given ID directly, for requests that
+// carry the ID some other way than in a cookie, e.g. a bearer token decoded
+// by the caller. Like New, it returns a fresh session with IsNew set if the
+// session does not exist or has expired. The session has no name, so saving
+// it sets no cookie; save it with SaveCtx. KindFunc is not consulted; the
+// store's kind is used.
+func (s *DatastoreStore) GetByID(c context.Context, id string) (*sessions.Session, error) {
+	session := newSession(s, "")
+	opts := *s.Options
+	if s.Domain != "" {
+		opts.Domain = s.Domain
+	}
+	if s.Path != "" {
+		opts.Path = s.Path
+	}
+	session.Options = &opts
+	session.IsNew = true
+	session.ID = id
+	err := s.load(c, s.kind, session)
+	if isNotFound(err) {
+		resetSession(session)
+		setState(session, StateExpired)
+		return session, nil
+	}
+	if err != nil {
+		return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+	}
+	markLoaded(session)
+	return session, nil
+}
+
+// GetAndDelete loads the session with the given ID and deletes it in one
+// transaction, so that of several concurrent calls only one gets the values,
+// e.g. to redeem a one-time token stored as a session. The returned session
+// has StateLoaded and IsNew set, since it is no longer stored. If the
+// session does not exist or has expired, it returns a fresh session with
+// StateExpired, like GetByID. KindFunc is not consulted.
+func (s *DatastoreStore) GetAndDelete(c context.Context, id string) (*sessions.Session, error) {
+	session := newSession(s, "")
+	opts := *s.Options
+	if s.Domain != "" {
+		opts.Domain = s.Domain
+	}
+	if s.Path != "" {
+		opts.Path = s.Path
+	}
+	session.Options = &opts
+	session.IsNew = true
+	session.ID = id
+	if err := contextErr(c, nil); err != nil {
+		return session, err
+	}
+	k := sessionKey(c, s.shardKind(s.kind, id), id, s.NumericIDs)
+	var entity Session
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		addOps(tc, opDatastoreRead, 1)
+		if err := datastore.Get(tc, k, &entity); err != nil {
+			return err
+		}
+		addOps(tc, opDatastoreWrite, 1)
+		return datastore.Delete(tc, k)
+	}, nil)
+	if err == nil && expired(entity.ExpirationDate, s.ExpirationGracePeriod) {
+		err = ErrSessionExpired
+	}
+	if isNotFound(err) {
+		resetSession(session)
+		setState(session, StateExpired)
+		return session, nil
+	}
+	if err != nil {
+		return session, fmt.Errorf("%w: %w", ErrSessionLoad, contextErr(c, err))
+	}
+	if err := s.encoding().decode(session.ID, entity.Value, &session.Values); err != nil {
+		return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+	}
+	setState(session, StateLoaded)
+	return session, nil
+}
+
+// Touch extends the expiration of the stored session with the given ID as if
+// it had just been saved with the store's default options. It neither loads
+// the session values nor writes a cookie, so it can keep the session of a
+// long-lived connection alive. A session that has expired, allowing for
+// ExpirationGracePeriod, is not revived: Touch returns ErrSessionExpired.
+func (s *DatastoreStore) Touch(c context.Context, id string) error {
+	_, err := touchDatastore(c, s.shardKind(s.kind, id), id, s.NumericIDs,
+		s.ExpirationGracePeriod, s.legacyExpiration(),
+		sessionExpiration(s.Options, s.nonPersistentSessionDuration))
+	return err
+}
+
+// Expire deletes the stored session with the given ID whatever its
+// expiration date, e.g. to revoke it, so that the next request carrying its
+// cookie gets a fresh session. It succeeds if the session is already gone.
+// OnExpire is not called.
+func (s *DatastoreStore) Expire(c context.Context, id string) error {
+	if err := contextErr(c, nil); err != nil {
+		return err
+	}
+	addOps(c, opDatastoreWrite, 1)
+	if err := datastore.Delete(c, sessionKey(c, s.shardKind(s.kind, id), id, s.NumericIDs)); err != nil {
+		return contextErr(c, err)
+	}
+	return nil
+}
+
+// ExtendExpiration moves the expiration of the stored session with the given
+// ID to d from now, like Touch but with an explicit duration. The stored
+// values are not decoded, so it also works for sessions written with a
+// serializer or key the store no longer uses; the datastore can only
+// rewrite whole entities, so the blob is still read and written back. It
+// does nothing if d is not positive, and returns ErrSessionExpired like Touch.
+func (s *DatastoreStore) ExtendExpiration(c context.Context, id string, d time.Duration) error {
+	_, err := touchDatastore(c, s.shardKind(s.kind, id), id, s.NumericIDs,
+		s.ExpirationGracePeriod, s.legacyExpiration(), d)
+	return err
+}
+
+// Exists reports whether an unexpired session with the given ID is stored.
+// The stored values are not read.
+func (s *DatastoreStore) Exists(c context.Context, id string) (bool, error) {
+	return existsInDatastore(c, s.shardKind(s.kind, id), id, s.NumericIDs, s.ExpirationGracePeriod)
+}
+
+// StoreConfig is a snapshot of the settings of a DatastoreStore, for
+// diagnostics. It holds no key material.
+type StoreConfig struct {
+	Kind                         string
+	ShardCount                   int
+	Options                      sessions.Options
+	NonPersistentSessionDuration time.Duration
+	ExpirationGracePeriod        time.Duration
+	Codecs                       int    // number of codecs, i.e. of key pairs in use
+	Format                       byte   // serializer format tag
+	Compression                  byte   // compressor algorithm tag, 0 if none
+	Transforms                   []byte // tags of the transforms, in order
+	AsyncWrite                   bool
+	OptimisticLocking            bool
+	SafeWrite                    bool
+	NumericIDs                   bool
+	Trace                        bool
+}
+
+// Config returns a snapshot of the store's settings, e.g. for a health check
+// endpoint to confirm that instances are configured as expected.
+func (s *DatastoreStore) Config() StoreConfig {
+	enc := s.encoding()
+	config := StoreConfig{
+		Kind:                         s.kind,
+		ShardCount:                   s.ShardCount,
+		NonPersistentSessionDuration: s.nonPersistentSessionDuration,
+		ExpirationGracePeriod:        s.ExpirationGracePeriod,
+		Codecs:                       len(s.codecs()),
+		Format:                       FormatGob,
+		AsyncWrite:                   s.AsyncWrite,
+		OptimisticLocking:            s.OptimisticLocking,
+		SafeWrite:                    s.SafeWrite,
+		NumericIDs:                   s.NumericIDs,
+		Trace:                        s.Trace,
+	}
+	if s.Options != nil {
+		config.Options = *s.Options
+	}
+	if enc.serializer != nil {
+		config.Format = enc.serializer.Format()
+	}
+	if enc.compressor != nil {
+		config.Compression = enc.compressor.Algorithm()
+	}
+	for _, t := range enc.transforms {
+		config.Transforms = append(config.Transforms, t.Tag())
+	}
+	return config
+}
+
+// SizeStats returns a histogram of the serialized sizes of the sessions saved
+// so far, to spot sessions growing towards the 1 MiB entity limit. It is
+// empty unless SizeHistogram is set.
+func (s *DatastoreStore) SizeStats() SizeStats {
+	return s.sizes.snapshot()
+}
+
+// EstimateSize returns the size in bytes of the blob that saving session
+// would store, after serialization, compression and transforms, without
+// writing anything. The entity adds some overhead on top of it; blobs must
+// stay below the 1 MiB entity limit.
+func (s *DatastoreStore) EstimateSize(session *sessions.Session) (int, error) {
+	b, err := s.encoding().encode(session.ID, session.Values)
+	return len(b), err
+}
+
+// Key returns the datastore key of the entity holding session, for use in
+// queries or transactions involving it. It is nil if session has not been
+// saved yet. The store's kind is used; with KindFunc, the key of the session
+// under another kind has the same ID.
+func (s *DatastoreStore) Key(c context.Context, session *sessions.Session) *datastore.Key {
+	if session.ID == "" {
+		return nil
+	}
+	return sessionKey(c, s.shardKind(s.kind, session.ID), session.ID, s.NumericIDs)
+}
+
+// ExpireFunc is called for each session removed because it expired. saved is
+// when the session was last saved and expired when it expired. It is called
+// right after the removal, so time.Since(expired) tells how far cleanup lags
+// behind expiration, including ExpirationGracePeriod; a growing lag means
+// cleanup should run more often or in larger batches.
+type ExpireFunc func(c context.Context, id string, saved, expired time.Time)
+
+// defaultCleanupTimeout bounds a run of CleanupHandler when the store's
+// CleanupTimeout is not set. It leaves ample room within the cron request
+// deadline; whatever is left over is removed by the next run.
+const defaultCleanupTimeout = time.Minute
+
+// CleanupHandler returns a handler that removes the store's expired sessions,
+// meant to be mounted at the URL of a cron job:
+//
+//	http.Handle("/tasks/removeExpiredSessions", store.CleanupHandler())
+//
+// Each request deletes in batches for at most CleanupTimeout and then
+// responds with 200 OK, even if expired sessions remain. It responds with 500
+// only if the datastore fails.
+func (s *DatastoreStore) CleanupHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := s.CleanupTimeout
+		if timeout <= 0 {
+			timeout = defaultCleanupTimeout
+		}
+		c, cancel := context.WithTimeout(appengine.NewContext(r), timeout)
+		defer cancel()
+		deleted, err := s.RemoveExpired(c, s.CleanupBatchSize, nil)
+		if err != nil && !errors.Is(err, ErrCanceled) {
+			logger(c).Errorf(c, "gaesessions: removing expired sessions: %v", err)
+			http.Error(w, "cannot remove expired sessions", http.StatusInternalServerError)
+			return
+		}
+		logger(c).Infof(c, "gaesessions: removed %d expired sessions", deleted)
+		fmt.Fprintf(w, "removed %d expired sessions\n", deleted)
+	})
+}
+
+// RemoveExpiredLabeled is like RemoveExpired but only removes sessions
+// carrying all of the given labels. Querying by label and expiration needs a
+// composite index on Labels and ExpirationDate for the store's kind.
+func (s *DatastoreStore) RemoveExpiredLabeled(c context.Context, labels map[string]string,
+	batchSize int, progress func(deleted int)) (int, error) {
+	return s.removeExpired(c, labels, batchSize, progress)
+}
+
+// RemoveExpired removes the store's expired sessions like
+// RemoveExpiredDatastoreSessionsInBatches, but keeps sessions within
+// ExpirationGracePeriod of their expiration date, which New would still
+// load, and calls OnExpire for each session removed.
+func (s *DatastoreStore) RemoveExpired(c context.Context, batchSize int,
+	progress func(deleted int)) (int, error) {
+	return s.removeExpired(c, nil, batchSize, progress)
+}
+
+// RemoveExpiredDryRun runs the queries RemoveExpiredLabeled would run for
+// labels, or RemoveExpired if labels is nil, without deleting anything. It
+// returns how many sessions would be removed and the keys of up to
+// sampleSize of them. Like the cleanup itself it stops with an error
+// wrapping ErrCanceled when c is done, returning what it counted so far.
+func (s *DatastoreStore) RemoveExpiredDryRun(c context.Context, labels map[string]string,
+	sampleSize int) (count int, sample []*datastore.Key, err error) {
+	for _, q := range s.expiredQueries(labels, expiredBefore(s.ExpirationGracePeriod)) {
+		count, sample, err = countQueried(c, q, count, sample, sampleSize)
+		if err != nil {
+			return count, sample, err
+		}
+	}
+	return count, sample, nil
+}
+
+// expiredQueries returns the queries for the sessions with the given labels
+// that expired at or before before, one per shard of the store's kind.
+func (s *DatastoreStore) expiredQueries(labels map[string]string, before time.Time) []*datastore.Query {
+	kinds := s.shardKinds()
+	queries := make([]*datastore.Query, len(kinds))
+	for i, kind := range kinds {
+		queries[i] = expiredQuery(kind, labels, before)
+	}
+	return queries
+}
+
+// removeExpired removes expired sessions with the given labels from every
+// shard of the store's kind in turn.
+func (s *DatastoreStore) removeExpired(c context.Context, labels map[string]string,
+	batchSize int, progress func(deleted int)) (int, error) {
+	total := 0
+	for _, q := range s.expiredQueries(labels, expiredBefore(s.ExpirationGracePeriod)) {
+		shardProgress := progress
+		if progress != nil {
+			base := total
+			shardProgress = func(deleted int) { progress(base + deleted) }
+		}
+		deleted, err := removeExpiredDatastoreSessions(c, q, batchSize, shardProgress, s.OnExpire)
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// PurgeOlderThan removes the stored sessions created before cutoff, whether
+// or not they have expired, e.g. to enforce a retention period. It deletes
+// batchSize sessions at a time (500 if batchSize is not positive or larger)
+// and returns how many it deleted. Sessions stored by earlier versions of the
+// package have no creation date; they are removed if they were last saved
+// before cutoff. OnExpire is not called.
+func (s *DatastoreStore) PurgeOlderThan(c context.Context, cutoff time.Time, batchSize int) (deleted int, err error) {
+	batchSize = cleanupBatchSize(batchSize)
+	for _, kind := range s.shardKinds() {
+		// A session is last saved after it is created, so the second query
+		// only adds sessions without Created, but may return some deleted
+		// by the first one while the index catches up.
+		purged := make(map[string]bool)
+		for _, property := range []string{"Created", "Date"} {
+			q := datastore.NewQuery(kind).Filter(property+" <", cutoff).KeysOnly()
+			n, err := deleteQueried(c, q, batchSize, purged)
+			deleted += n
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+	return deleted, nil
+}
+
+// deleteQueried deletes the sessions returned by the keys-only query q,
+// batchSize at a time, reading them with a single iterator so that no key is
+// returned twice. Keys in purged are skipped, and deleted keys are added to
+// it. It returns how many sessions it deleted.
+func deleteQueried(c context.Context, q *datastore.Query, batchSize int,
+	purged map[string]bool) (deleted int, err error) {
+	t := q.Run(c)
+	keys := make([]*datastore.Key, 0, batchSize)
+	for done := false; !done; {
+		if err := contextErr(c, nil); err != nil {
+			return deleted, err
+		}
+		keys = keys[:0]
+		for len(keys) < batchSize {
+			k, err := t.Next(nil)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return deleted, contextErr(c, err)
+			}
+			if !purged[k.Encode()] {
+				keys = append(keys, k)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		addOps(c, opDatastoreWrite, len(keys))
+		if err := nds.DeleteMulti(c, keys); err != nil {
+			return deleted, contextErr(c, err)
+		}
+		for _, k := range keys {
+			purged[k.Encode()] = true
+		}
+		deleted += len(keys)
+	}
+	return deleted, nil
+}
+
+// SessionMeta describes a stored session without its values.
+type SessionMeta struct {
+	ID             string
+	Date           time.Time
+	ExpirationDate time.Time
+	Version        int64
+	Labels         []string
+}
+
+// Query returns the unexpired sessions whose value under key, which must be
+// one of IndexedKeys, equals value. Only sessions saved since key was added
+// to IndexedKeys are found. The stored values are not decoded. KindFunc is
+// not consulted.
+//
+// Query reads at most limit sessions (500 if limit is not positive or
+// larger), starting where the query that returned cursor stopped, or at the
+// beginning if cursor is empty. Expired sessions count towards limit but are
+// left out, so a page may hold fewer sessions. The returned cursor continues
+// the query, and is empty once every session has been read.
+func (s *DatastoreStore) Query(c context.Context, key string, value interface{},
+	limit int, cursor string) ([]SessionMeta, string, error) {
+	v, ok := indexedValue(value)
+	if !ok {
+		return nil, "", fmt.Errorf("gaesessions: cannot query by value of type %T", value)
+	}
+	prop := property(key, v)
+	if len(prop) > maxIndexedStringLen {
+		// Such values are not indexed, so no session can match.
+		return nil, "", nil
+	}
+	shard, start, err := parseQueryCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	limit = cleanupBatchSize(limit)
+	kinds := s.shardKinds()
+	var metas []SessionMeta
+	for read := 0; shard < len(kinds); shard, start = shard+1, nil {
+		q := datastore.NewQuery(kinds[shard]).Filter("Indexed =", prop).Limit(limit - read)
+		if start != nil {
+			q = q.Start(*start)
+		}
+		addOps(c, opDatastoreRead, 1)
+		t := q.Run(c)
+		for {
+			var e Session
+			k, err := t.Next(&e)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				return metas, "", contextErr(c, err)
+			}
+			addOps(c, opDatastoreRead, 1)
+			read++
+			if expired(e.ExpirationDate, s.ExpirationGracePeriod) {
+				continue
+			}
+			metas = append(metas, SessionMeta{
+				ID:             keyID(k),
+				Date:           e.Date,
+				ExpirationDate: e.ExpirationDate,
+				Version:        e.Version,
+				Labels:         e.Labels,
+			})
+		}
+		if read == limit {
+			next, err := t.Cursor()
+			if err != nil {
+				return metas, "", contextErr(c, err)
+			}
+			return metas, strconv.Itoa(shard) + ":" + next.String(), nil
+		}
+	}
+	return metas, "", nil
+}
+
+// parseQueryCursor splits a cursor returned by Query into the index of the
+// shard it stopped in and the datastore cursor within that shard, which is
+// nil if the cursor is empty.
+func parseQueryCursor(cursor string) (int, *datastore.Cursor, error) {
+	if cursor == "" {
+		return 0, nil, nil
+	}
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return 0, nil, errors.New("gaesessions: invalid query cursor")
+	}
+	shard, err := strconv.Atoi(cursor[:i])
+	if err != nil || shard < 0 {
+		return 0, nil, errors.New("gaesessions: invalid query cursor")
+	}
+	start, err := datastore.DecodeCursor(cursor[i+1:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("gaesessions: invalid query cursor: %w", err)
+	}
+	return shard, &start, nil
+}
+
+// save writes the session under kind and adds its cookie to the response.
+func (s *DatastoreStore) save(c context.Context, kind string,
+	w http.ResponseWriter, session *sessions.Session) (int, error) {
+	if s.SkipEmptyNewSessions && session.IsNew && len(session.Values) == 0 {
+		return 0, nil
+	}
+	if savedUnchanged(session, s.encoding()) {
+		return 0, nil
+	}
+	if session.ID == "" && s.InlineThreshold > 0 {
+		blob, err := s.encoding().encode(session.ID, session.Values)
+		if err != nil {
+			return 0, err
+		}
+		if len(blob) < s.InlineThreshold {
+			return 0, s.saveInline(c, w, session, blob)
+		}
+	}
+	baseKind := kind
+	var oldID string
+	var oldVersion int64
+	var oldHash []byte
+	if s.RotateOnEverySave && session.ID != "" && !session.IsNew &&
+		sessionExpiration(session.Options, s.nonPersistentSessionDuration) > 0 {
+		m := metaOf(session)
+		oldID, oldVersion, oldHash = session.ID, m.version, m.hash
+		session.ID, m.version, m.hash = "", 0, nil
+	}
+	if session.ID == "" && s.NumericIDs {
+		addOps(c, opDatastoreSmall, 1)
+		low, _, err := datastore.AllocateIDs(c, kind, nil, 1)
+		if err != nil {
+			return 0, contextErr(c, err)
+		}
+		session.ID = strconv.FormatInt(low, 10)
+	}
+	if len(s.IndexedKeys) > 0 {
+		metaOf(session).indexed = indexedProperties(session.Values, s.IndexedKeys)
+	}
+	create := false
+	if session.ID == "" {
+		id, err := newSessionID(s.Rand, s.IDEncoding)
+		if err != nil {
+			return 0, err
+		}
+		session.ID = id
+		create = s.CheckIDCollision
+	}
+	// The old ID of a rotated session only keeps working for the grace
+	// period, so the new entity must exist before the cookie moves to it.
+	async := s.AsyncWrite && oldID == ""
+	c, span := startSpan(c, s.Trace, "datastore.save", session.ID)
+	size, err := saveToDatastore(c, s.shardKind(kind, session.ID), s.NumericIDs, s.encoding(), s.nonPersistentSessionDuration, async, s.TaskHook, s.WriteTaskPath, s.OptimisticLocking, s.SafeWrite, create, s.PersistEmpty, session)
+	for attempt := 1; err == ErrIDCollision && attempt < idCollisionAttempts; attempt++ {
+		logger(c).Warningf(c, "gaesessions: session ID %s is taken, generating another", session.ID)
+		id, idErr := newSessionID(s.Rand, s.IDEncoding)
+		if idErr != nil {
+			err = idErr
+			break
+		}
+		session.ID = id
+		size, err = saveToDatastore(c, s.shardKind(kind, session.ID), s.NumericIDs, s.encoding(), s.nonPersistentSessionDuration, async, s.TaskHook, s.WriteTaskPath, s.OptimisticLocking, s.SafeWrite, create, s.PersistEmpty, session)
+	}
+	span.end(err)
+	if err != nil && oldID != "" {
+		m := metaOf(session)
+		session.ID, m.version, m.hash = oldID, oldVersion, oldHash
+	}
+	if err != nil {
+		return 0, err
+	}
+	if oldID != "" {
+		grace := s.RotationGracePeriod
+		if grace <= 0 {
+			grace = defaultRotationGracePeriod
+		}
+		// The session is already stored under its new ID, so failing here
+		// would orphan it; the old ID merely lives on until it expires.
+		_, err := touchDatastore(c, s.shardKind(baseKind, oldID), oldID, s.NumericIDs,
+			s.ExpirationGracePeriod, s.legacyExpiration(), grace)
+		if err != nil && !isNotFound(err) {
+			logger(c).Warningf(c, "gaesessions: shortening old ID %s of rotated session: %v", oldID, err)
+		}
+	}
+	if s.SizeHistogram && size > 0 {
+		s.sizes.record(size)
+	}
+	if s.OnlySetCookieOnNewID && cookieUnchanged(session) {
+		markSaved(c, session, s.encoding())
+		return size, nil
+	}
+	name := cookieName(s.CookieNameFunc, session.Name())
+	encoded, err := encodeCookieID(c, name, session.ID, s.CookieTransform, s.codecs())
+	if err != nil {
+		return 0, err
+	}
+	cookie := sessions.NewCookie(name, encoded, session.Options)
+	if err := checkCookiePrefix(cookie); err != nil {
+		return 0, err
+	}
+	if err := checkCookieLength(cookie, s.MaxCookieLength); err != nil {
+		return 0, err
+	}
+	if err := setCookie(c, w, cookie); err != nil {
+		return 0, err
+	}
+	markSaved(c, session, s.encoding())
+	return size, nil
+}
+
+// saveInline sets a cookie holding blob, the encoded values of session, in
+// place of its ID. See InlineThreshold.
+func (s *DatastoreStore) saveInline(c context.Context, w http.ResponseWriter,
+	session *sessions.Session, blob []byte) error {
+	name := cookieName(s.CookieNameFunc, session.Name())
+	encoded, err := encodeCookieID(c, name, inlinePrefix+string(blob), s.CookieTransform, s.codecs())
+	if err != nil {
+		return err
+	}
+	cookie := sessions.NewCookie(name, encoded, session.Options)
+	if err := checkCookiePrefix(cookie); err != nil {
+		return err
+	}
+	if err := checkCookieLength(cookie, s.MaxCookieLength); err != nil {
+		return err
+	}
+	if err := setCookie(c, w, cookie); err != nil {
+		return err
+	}
+	markSaved(c, session, s.encoding())
+	return nil
+}
+
+// load reads the session's values from kind.
+func (s *DatastoreStore) load(c context.Context, kind string,
+	session *sessions.Session) error {
+	c, span := startSpan(c, s.Trace, "datastore.load", session.ID)
+	err := loadFromDatastore(c, s.shardKind(kind, session.ID), s.NumericIDs, s.encoding(), s.ExpirationGracePeriod, s.legacyExpiration(), session)
+	span.end(err)
+	return err
+}
+
+// legacyExpiration returns how long after its Date a session stored without
+// an expiration date expires, or 0 unless LegacyCompat is set.
+func (s *DatastoreStore) legacyExpiration() time.Duration {
+	if !s.LegacyCompat {
+		return 0
+	}
+	return sessionExpiration(s.Options, s.nonPersistentSessionDuration)
+}
+
+// kindFor returns the kind used to store sessions for r.
+func (s *DatastoreStore) kindFor(r *http.Request) string {
+	if s.KindFunc != nil {
+		if kind := s.KindFunc(r); kind != "" {
+			return kind
+		}
+	}
+	return s.kind
+}
+
+// shardKind returns the kind holding the session with the given ID: kind
+// itself, or with ShardCount set, one of ShardCount kinds derived from it,
+// picked by hashing the ID.
+func (s *DatastoreStore) shardKind(kind, id string) string {
+	if s.ShardCount <= 1 {
+		return kind
+	}
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return shardName(kind, int(h.Sum32()%uint32(s.ShardCount)))
+}
+
+// shardKinds returns the kinds of every shard of the store's kind.
+func (s *DatastoreStore) shardKinds() []string {
+	if s.ShardCount <= 1 {
+		return []string{s.kind}
+	}
+	kinds := make([]string, s.ShardCount)
+	for i := range kinds {
+		kinds[i] = shardName(s.kind, i)
+	}
+	return kinds
+}
+
+// shardName returns the name of shard i of kind.
+func shardName(kind string, i int) string {
+	return kind + "_" + strconv.Itoa(i)
+}
+
+// sessionKey returns the datastore key of the session with the given ID. If
+// numeric is true, as for stores with NumericIDs, decimal IDs map to integer
+// keys. Other IDs map to string keys.
+func sessionKey(c context.Context, kind, id string, numeric bool) *datastore.Key {
+	if numeric {
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && n > 0 && strconv.FormatInt(n, 10) == id {
+			return datastore.NewKey(c, kind, "", n, nil)
+		}
+	}
+	return datastore.NewKey(c, kind, id, 0, nil)
+}
+
+// keyID returns the session ID of a key made by sessionKey.
+func keyID(k *datastore.Key) string {
+	if k.IntID() != 0 {
+		return strconv.FormatInt(k.IntID(), 10)
+	}
+	return k.StringID()
+}
+
+// save writes encoded session.Values to datastore and returns the number of
+// serialized bytes stored. If async is true the write is handed to a task
+// queue task, posted to taskPath if set and run by the delay package
+// otherwise, and passed to taskHook if set, instead of being made directly,
+// unless safe is true, in which case the write is checked against the hash
+// of the loaded blob, or create is true, in which case it fails with
+// ErrIDCollision if a session is already stored under the ID. If the task
+// cannot be enqueued, the write is made directly after all.
+func saveToDatastore(c context.Context, kind string, numeric bool, enc blobEncoding,
+	nonPersistentSessionDuration time.Duration, async bool,
+	taskHook func(t *taskqueue.Task, id string), taskPath string, locking, safe, create, persistEmpty bool,
+	session *sessions.Session) (int, error) {
+	if !persistEmpty && len(session.Values) == 0 {
+		// Don't need to write anything.
+		return 0, nil
+	}
+	serialized, err := enc.encode(session.ID, session.Values)
+	if err != nil {
+		return 0, err
+	}
+	if err := contextErr(c, nil); err != nil {
+		return 0, err
+	}
+	m := metaOf(session)
+	var entity Session
+	if expiration := sessionExpiration(session.Options, nonPersistentSessionDuration); expiration > 0 {
+		now := time.Now()
+		created := m.created
+		if created.IsZero() && session.IsNew {
+			created = now
+		}
+		entity = Session{
+			Date:           now,
+			Created:        created,
+			ExpirationDate: now.Add(expiration),
+			Value:          serialized,
+			Version:        m.version + 1,
+			Labels:         labelProperties(m.labels),
+			Indexed:        m.indexed,
+		}
+	}
+	if async && !safe && !create {
+		t, err := newWriteTask(taskPath, kind, session.ID, numeric, entity, locking)
+		if err != nil {
+			return 0, err
+		}
+		if taskHook != nil {
+			taskHook(t, session.ID)
+		}
+		err = addTask(c, t, func(c context.Context) error {
+			return runWriteTask(c, kind, session.ID, numeric, entity, locking)
+		})
+		if err == nil {
+			return len(entity.Value), nil
+		}
+		if err == taskqueue.ErrTaskAlreadyAdded || c.Err() != nil {
+			return 0, contextErr(c, err)
+		}
+		logger(c).Warningf(c, "gaesessions: enqueueing write of session %s, writing directly: %v", session.ID, err)
+	}
+	var loadedHash []byte
+	if safe {
+		loadedHash = m.hash
+	}
+	if err := writeSession(c, kind, session.ID, numeric, &entity, locking, create, loadedHash); err != nil {
+		return 0, contextErr(c, err)
+	}
+	if entity.Version > 0 {
+		m.version, m.hash, m.created = entity.Version, blobHash(entity.Value), entity.Created
 	}
+	return len(entity.Value), nil
 }
 
-// DatastoreStore stores sessions in the App Engine datastore.
-type DatastoreStore struct {
-	Codecs                       []securecookie.Codec
-	Options                      *sessions.Options // default configuration
-	kind                         string
-	nonPersistentSessionDuration time.Duration
+// writeSessionFunc runs writeSession from a task queue task for stores with
+// AsyncWrite enabled. A version conflict is logged and the write dropped,
+// since retrying the task cannot resolve it.
+var writeSessionFunc = delay.Func("gaesessions.writeSession", runWriteTask)
+
+// runWriteTask runs the write of an AsyncWrite task.
+func runWriteTask(c context.Context, kind, id string, numeric bool, entity Session, locking bool) error {
+	err := writeSession(c, kind, id, numeric, &entity, locking, false, nil)
+	if err == ErrVersionConflict {
+		logger(c).Warningf(c, "gaesessions: dropping write of session %s: %v", id, err)
+		return nil
+	}
+	return err
 }
 
-// Get returns a session for the given name after adding it to the registry.
-//
-// See CookieStore.Get().
-func (s *DatastoreStore) Get(r *http.Request, name string) (*sessions.Session,
-	error) {
-	return sessions.GetRegistry(r).Get(s, name)
+// writeTask is the gob-encoded payload of an AsyncWrite task posted to a
+// store's WriteTaskPath.
+type writeTask struct {
+	Kind    string
+	ID      string
+	Numeric bool
+	Entity  Session
+	Locking bool
 }
 
-// New returns a session for the given name without adding it to the registry.
+// newWriteTask returns the task writing entity for an AsyncWrite store: a
+// POST to path if it is set, or a delay package task otherwise.
+func newWriteTask(path, kind, id string, numeric bool, entity Session, locking bool) (*taskqueue.Task, error) {
+	if path == "" {
+		return writeSessionFunc.Task(kind, id, numeric, entity, locking)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(writeTask{kind, id, numeric, entity, locking}); err != nil {
+		return nil, err
+	}
+	return &taskqueue.Task{
+		Path:    path,
+		Payload: buf.Bytes(),
+		Header:  http.Header{"Content-Type": {"application/octet-stream"}},
+		Method:  "POST",
+	}, nil
+}
+
+// WriteTaskHandler returns the handler running the AsyncWrite tasks of
+// stores with a WriteTaskPath, to be mounted at that path:
 //
-// See CookieStore.New().
-func (s *DatastoreStore) New(r *http.Request, name string) (*sessions.Session,
-	error) {
-	session := sessions.NewSession(s, name)
-	opts := *s.Options
-	session.Options = &opts
-	session.IsNew = true
+//	http.Handle("/tasks/writeSession", gaesessions.WriteTaskHandler())
+//
+// It only accepts requests made by the task queue. It responds with 500 if
+// the write fails, so that the task is retried.
+func WriteTaskHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-AppEngine-TaskName") == "" {
+			http.Error(w, "not a task queue request", http.StatusForbidden)
+			return
+		}
+		c := appengine.NewContext(r)
+		var t writeTask
+		if err := gob.NewDecoder(r.Body).Decode(&t); err != nil {
+			// Retrying cannot help, so drop the task.
+			logger(c).Errorf(c, "gaesessions: dropping undecodable write task: %v", err)
+			return
+		}
+		if err := runWriteTask(c, t.Kind, t.ID, t.Numeric, t.Entity, t.Locking); err != nil {
+			logger(c).Errorf(c, "gaesessions: writing session %s: %v", t.ID, err)
+			http.Error(w, "cannot write session", http.StatusInternalServerError)
+		}
+	})
+}
+
+// taskAddAttempts is the number of times addTask tries to enqueue a task.
+const taskAddAttempts = 3
+
+// addTask adds t, which makes the write done by write, to the batch of c, if
+// any, or to the default queue, retrying transient failures with jittered
+// backoff. A duplicate task name is not retried.
+func addTask(c context.Context, t *taskqueue.Task, write func(c context.Context) error) error {
+	if batchTask(c, t, write) {
+		return nil
+	}
+	backoff := 20 * time.Millisecond
 	var err error
-	if cookie, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, cookie.Value, &session.ID,
-			s.Codecs...)
-		if err == nil {
-			c := appengine.NewContext(r)
-			err = loadFromDatastore(c, s.kind, session)
-			if err == nil {
-				session.IsNew = false
+	for i := 0; i < taskAddAttempts; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(backoff/2 + time.Duration(mathrand.Int63n(int64(backoff)))):
+			case <-c.Done():
+				return c.Err()
 			}
+			backoff *= 2
+		}
+		addOps(c, opTask, 1)
+		if _, err = taskqueue.Add(c, t, ""); err == nil || err == taskqueue.ErrTaskAlreadyAdded {
+			return err
 		}
 	}
-	return session, err
+	return err
 }
 
-// Save adds a single session to the response.
-func (s *DatastoreStore) Save(r *http.Request, w http.ResponseWriter,
-	session *sessions.Session) error {
-	if session.ID == "" {
-		session.ID =
-			strings.TrimRight(
-				base32.StdEncoding.EncodeToString(
-					securecookie.GenerateRandomKey(32)), "=")
+// writeSession puts entity under kind and id, or deletes the stored session
+// if entity is the zero Session. If locking is true the put only succeeds if
+// the stored version is the one entity was derived from; otherwise it fails
+// with ErrVersionConflict. If loadedHash is not nil the put only succeeds if
+// the stored blob still has that hash; otherwise it fails with
+// ErrConcurrentModification. If create is true the put only succeeds if no
+// session is stored under id; otherwise it fails with ErrIDCollision. If
+// entity.Created is zero, e.g. for a session MemcacheDatastoreStore loaded
+// from memcache, the Created of the stored session is kept, read in the same
+// transaction, and entity.Date is used if there is none.
+func writeSession(c context.Context, kind, id string, numeric bool, entity *Session,
+	locking, create bool, loadedHash []byte) error {
+	k := sessionKey(c, kind, id, numeric)
+	if entity.ExpirationDate.IsZero() {
+		addOps(c, opDatastoreWrite, 1)
+		return datastore.Delete(c, k)
 	}
-	c := appengine.NewContext(r)
-	if err := saveToDatastore(c, s.kind, s.nonPersistentSessionDuration, session); err != nil {
+	keepCreated := entity.Created.IsZero()
+	if !locking && !create && loadedHash == nil && !keepCreated {
+		addOps(c, opDatastoreWrite, 1)
+		_, err := datastore.Put(c, k, entity)
 		return err
 	}
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
-	if err != nil {
+	return datastore.RunInTransaction(c, func(tc context.Context) error {
+		var stored Session
+		addOps(tc, opDatastoreRead, 1)
+		err := datastore.Get(tc, k, &stored)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if create && err == nil {
+			return ErrIDCollision
+		}
+		if locking && stored.Version != entity.Version-1 {
+			return ErrVersionConflict
+		}
+		if loadedHash != nil && !bytes.Equal(blobHash(stored.Value), loadedHash) {
+			return ErrConcurrentModification
+		}
+		if keepCreated {
+			entity.Created = stored.Created
+			if entity.Created.IsZero() {
+				entity.Created = stored.Date
+			}
+			if entity.Created.IsZero() {
+				entity.Created = entity.Date
+			}
+		}
+		addOps(tc, opDatastoreWrite, 1)
+		_, err = datastore.Put(tc, k, entity)
+		return err
+	}, nil)
+}
+
+// load gets a value from datastore and decodes its content into
+// session.Values. Sessions that expired more than grace ago are reported as
+// ErrSessionExpired. If legacyExpiration is positive, a session stored
+// without an expiration date expires legacyExpiration after its Date.
+func loadFromDatastore(c context.Context, kind string, numeric bool, enc blobEncoding,
+	grace, legacyExpiration time.Duration, session *sessions.Session) error {
+	if err := contextErr(c, nil); err != nil {
 		return err
 	}
-	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded,
-		session.Options))
+	k := sessionKey(c, kind, session.ID, numeric)
+	entity := Session{}
+	addOps(c, opDatastoreRead, 1)
+	if err := datastore.Get(c, k, &entity); err != nil {
+		return contextErr(c, err)
+	}
+	if entity.ExpirationDate.IsZero() && legacyExpiration > 0 {
+		entity.ExpirationDate = entity.Date.Add(legacyExpiration)
+	}
+	if expired(entity.ExpirationDate, grace) {
+		return ErrSessionExpired
+	}
+	if err := enc.decode(session.ID, entity.Value, &session.Values); err != nil {
+		return err
+	}
+	if entity.Created.IsZero() {
+		entity.Created = entity.Date
+	}
+	m := metaOf(session)
+	m.version, m.hash, m.created = entity.Version, blobHash(entity.Value), entity.Created
 	return nil
 }
 
-// save writes encoded session.Values to datastore.
-func saveToDatastore(c context.Context, kind string,
-	nonPersistentSessionDuration time.Duration,
-	session *sessions.Session) error {
-	if len(session.Values) == 0 {
-		// Don't need to write anything.
-		return nil
+// existsInDatastore reports whether a session with the given ID that has not
+// expired more than grace ago is stored under kind. It queries only the
+// session's ExpirationDate rather than read its blob. Sessions without an
+// ExpirationDate are missing from the projection, as they would count as
+// expired anyway.
+func existsInDatastore(c context.Context, kind, id string, numeric bool,
+	grace time.Duration) (bool, error) {
+	if err := contextErr(c, nil); err != nil {
+		return false, err
 	}
-	serialized, err := serialize(session.Values)
-	if err != nil {
-		return err
+	k := sessionKey(c, kind, id, numeric)
+	var entities []Session
+	q := datastore.NewQuery(kind).Filter("__key__ =", k).Project("ExpirationDate").Limit(1)
+	addOps(c, opDatastoreRead, 1)
+	if _, err := q.GetAll(c, &entities); err != nil {
+		return false, contextErr(c, err)
 	}
-	k := datastore.NewKey(c, kind, session.ID, 0, nil)
-	now := time.Now()
-	var expirationDate time.Time
-	var expiration time.Duration
-	if session.Options.MaxAge > 0 {
-		expiration = time.Duration(session.Options.MaxAge) * time.Second
-	} else {
-		expiration = nonPersistentSessionDuration
+	return len(entities) == 1 && !expired(entities[0].ExpirationDate, grace), nil
+}
+
+// expired reports whether a session with the given expiration date has
+// expired, allowing for grace to absorb clock skew between instances. A
+// session expires at the instant its expiration date plus grace is reached,
+// so it is expired exactly when the cleanup queries, which select
+// ExpirationDate <= expiredBefore(grace), would delete it.
+func expired(expirationDate time.Time, grace time.Duration) bool {
+	return !expiredBefore(grace).Before(expirationDate)
+}
+
+// expiredBefore returns the latest expiration date of sessions that have
+// expired, given grace.
+func expiredBefore(grace time.Duration) time.Time {
+	return time.Now().Add(-grace)
+}
+
+// touchDatastore moves the expiration date of a stored session to now plus
+// expiration and returns the updated entity. It does nothing and returns nil
+// if expiration is not positive. Like loadFromDatastore, it reports a session
+// that expired more than grace ago as ErrSessionExpired rather than reviving
+// it before the cleanup gets to it.
+func touchDatastore(c context.Context, kind, id string, numeric bool,
+	grace, legacyExpiration, expiration time.Duration) (*Session, error) {
+	if expiration <= 0 {
+		return nil, nil
 	}
-	if expiration > 0 {
-		expirationDate = now.Add(expiration)
-		k, err = datastore.Put(c, k, &Session{
-			Date:           now,
-			ExpirationDate: expirationDate,
-			Value:          serialized,
-		})
-		if err != nil {
+	if err := contextErr(c, nil); err != nil {
+		return nil, err
+	}
+	k := sessionKey(c, kind, id, numeric)
+	entity := &Session{}
+	err := datastore.RunInTransaction(c, func(tc context.Context) error {
+		addOps(tc, opDatastoreRead, 1)
+		if err := datastore.Get(tc, k, entity); err != nil {
 			return err
 		}
-	} else {
-		err = datastore.Delete(c, k)
-		if err != nil {
+		if err := extendEntity(entity, grace, legacyExpiration, expiration); err != nil {
 			return err
 		}
+		addOps(tc, opDatastoreWrite, 1)
+		_, err := datastore.Put(tc, k, entity)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, contextErr(c, err)
 	}
-	return nil
+	return entity, nil
 }
 
-// load gets a value from datastore and decodes its content into
-// session.Values.
-func loadFromDatastore(c context.Context, kind string,
-	session *sessions.Session) error {
-	k := datastore.NewKey(c, kind, session.ID, 0, nil)
-	entity := Session{}
-	if err := datastore.Get(c, k, &entity); err != nil {
-		return err
+// extendEntity moves the expiration date of entity to now plus expiration,
+// or returns ErrSessionExpired if it expired more than grace ago. If
+// legacyExpiration is positive, an entity without an expiration date expires
+// legacyExpiration after its Date.
+func extendEntity(entity *Session, grace, legacyExpiration, expiration time.Duration) error {
+	if entity.ExpirationDate.IsZero() && legacyExpiration > 0 {
+		entity.ExpirationDate = entity.Date.Add(legacyExpiration)
 	}
-	if err := deserialize(entity.Value, &session.Values); err != nil {
-		return err
+	if expired(entity.ExpirationDate, grace) {
+		return ErrSessionExpired
 	}
+	entity.ExpirationDate = time.Now().Add(expiration)
 	return nil
 }
 
 func RemoveExpiredDatastoreSessions(c context.Context, kind string) error {
-	keys, err := findExpiredDatastoreSessionKeys(c, kind)
-	if err != nil {
-		return err
+	_, err := RemoveExpiredDatastoreSessionsInBatches(c, kind, 0, nil)
+	return err
+}
+
+// defaultCleanupBatchSize is the number of keys deleted per batch when
+// removing expired sessions; it is the datastore's per-call entity limit.
+const defaultCleanupBatchSize = 500
+
+// idCollisionAttempts is the number of IDs Save tries for a new session when
+// CheckIDCollision is set.
+const idCollisionAttempts = 3
+
+// defaultRotationGracePeriod is used when RotationGracePeriod is not set.
+const defaultRotationGracePeriod = 10 * time.Second
+
+// cleanupBatchSize returns n, or defaultCleanupBatchSize if n is not positive
+// or exceeds it. Sessions are deleted outside transactions, each batch in a
+// single call, so only the per-call limit applies.
+func cleanupBatchSize(n int) int {
+	if n <= 0 || n > defaultCleanupBatchSize {
+		return defaultCleanupBatchSize
+	}
+	return n
+}
+
+// RemoveExpiredDatastoreSessionsInBatches removes expired sessions of the
+// given kind batchSize keys at a time (500 if batchSize is not positive or
+// larger) and returns how many it deleted. Sessions whose ExpirationDate is
+// at or before the current time are expired; use DatastoreStore.RemoveExpired
+// to honor an ExpirationGracePeriod. If progress is not nil it is called
+// after each batch with the running total.
+//
+// The context is checked between batches, so a long cleanup can be stopped
+// by cancelling it; the sessions deleted so far are reported together with an
+// error wrapping ErrCanceled.
+func RemoveExpiredDatastoreSessionsInBatches(c context.Context, kind string,
+	batchSize int, progress func(deleted int)) (deleted int, err error) {
+	if kind == "" {
+		kind = defaultKind
 	}
-	return nds.DeleteMulti(c, keys)
+	return removeExpiredDatastoreSessions(c, expiredQuery(kind, nil, expiredBefore(0)), batchSize, progress, nil)
 }
 
-func findExpiredDatastoreSessionKeys(c context.Context, kind string) (keys []*datastore.Key, err error) {
+// RemoveExpiredDatastoreSessionsDryRun runs the query used to remove expired
+// sessions of the given kind without deleting anything. It returns how many
+// sessions would be removed and the keys of up to sampleSize of them, e.g.
+// to check what a cleanup would do before running it for real. Like the
+// cleanup itself it stops with an error wrapping ErrCanceled when c is done,
+// returning what it counted so far. Use DatastoreStore.RemoveExpiredDryRun to
+// check a store's cleanup, which honors its ExpirationGracePeriod, shards and
+// labels.
+func RemoveExpiredDatastoreSessionsDryRun(c context.Context, kind string,
+	sampleSize int) (count int, sample []*datastore.Key, err error) {
 	if kind == "" {
 		kind = defaultKind
 	}
-	now := time.Now()
-	q := datastore.NewQuery(kind).Filter("ExpirationDate <=", now).KeysOnly()
-	keys, err = q.GetAll(c, nil)
-	return
+	return countQueried(c, expiredQuery(kind, nil, expiredBefore(0)), 0, nil, sampleSize)
+}
+
+// expiredQuery returns the query for the sessions of kind with the given
+// labels that expired at or before before.
+func expiredQuery(kind string, labels map[string]string, before time.Time) *datastore.Query {
+	q := datastore.NewQuery(kind).Filter("ExpirationDate <=", before)
+	for _, label := range labelProperties(labels) {
+		q = q.Filter("Labels =", label)
+	}
+	return q
+}
+
+// countQueried adds the number of keys q selects to count, and appends them
+// to sample until it holds sampleSize keys.
+func countQueried(c context.Context, q *datastore.Query, count int,
+	sample []*datastore.Key, sampleSize int) (int, []*datastore.Key, error) {
+	for t := q.KeysOnly().Run(c); ; count++ {
+		if err := contextErr(c, nil); err != nil {
+			return count, sample, err
+		}
+		k, err := t.Next(nil)
+		if err == datastore.Done {
+			return count, sample, nil
+		}
+		if err != nil {
+			return count, sample, contextErr(c, err)
+		}
+		if len(sample) < sampleSize {
+			sample = append(sample, k)
+		}
+	}
+}
+
+// removeExpiredDatastoreSessions implements
+// RemoveExpiredDatastoreSessionsInBatches, deleting the sessions selected by
+// q, an expiredQuery. If onExpire is not nil, whole entities are fetched
+// rather than keys only, and onExpire is called for each of them once its
+// batch has been deleted.
+func removeExpiredDatastoreSessions(c context.Context, q *datastore.Query,
+	batchSize int, progress func(deleted int), onExpire ExpireFunc) (deleted int, err error) {
+	batchSize = cleanupBatchSize(batchSize)
+	if onExpire == nil {
+		q = q.KeysOnly()
+	}
+	t := q.Run(c)
+	keys := make([]*datastore.Key, 0, batchSize)
+	var entities []Session
+	for done := false; !done; {
+		if err := contextErr(c, nil); err != nil {
+			return deleted, err
+		}
+		keys, entities = keys[:0], entities[:0]
+		for len(keys) < batchSize {
+			var entity Session
+			var dst interface{}
+			if onExpire != nil {
+				dst = &entity
+			}
+			k, err := t.Next(dst)
+			if err == datastore.Done {
+				done = true
+				break
+			}
+			if err != nil {
+				return deleted, contextErr(c, err)
+			}
+			keys = append(keys, k)
+			if onExpire != nil {
+				entities = append(entities, entity)
+			}
+		}
+		if len(keys) == 0 {
+			break
+		}
+		addOps(c, opDatastoreWrite, len(keys))
+		if err := nds.DeleteMulti(c, keys); err != nil {
+			return deleted, contextErr(c, err)
+		}
+		for i, entity := range entities {
+			onExpire(c, keyID(keys[i]), entity.Date, entity.ExpirationDate)
+		}
+		deleted += len(keys)
+		if progress != nil {
+			progress(deleted)
+		}
+	}
+	return deleted, nil
 }
 
 // MemcacheStore --------------------------------------------------------------
@@ -304,10 +2724,7 @@ func NewMemcacheStore(keyPrefix string, nonPersistentSessionDuration time.Durati
 	}
 	return &MemcacheStore{
 		Codecs: securecookie.CodecsFromPairs(keyPairs...),
-		Options: &sessions.Options{
-			Path:   "/",
-			MaxAge: 86400 * 30,
-		},
+		Options: defaultOptions(),
 		prefix: keyPrefix,
 		nonPersistentSessionDuration: nonPersistentSessionDuration,
 	}
@@ -315,13 +2732,135 @@ func NewMemcacheStore(keyPrefix string, nonPersistentSessionDuration time.Durati
 
 // MemcacheStore stores sessions in the App Engine memcache.
 type MemcacheStore struct {
+	// Domain, if set, is copied into the options of every new session.
+	Domain string
+	// Path, if set, is copied into the options of every new session.
+	// Otherwise the path from Options is used, which defaults to "/".
+	Path string
+	// MaxCookieLength is the maximum length of the session cookie's name and
+	// value. Save fails with ErrCookieTooLong rather than set a longer
+	// cookie, which browsers would drop. If 0, 4096 is used; if negative, the
+	// length is not checked.
+	MaxCookieLength int
+	// PrefixFunc, if set, returns the memcache key prefix for a request,
+	// e.g. one per tenant, overriding the store's prefix. New ignores
+	// cookies carrying a session ID other than the request's prefix followed
+	// by a generated ID, so sessions of one tenant are never visible to
+	// another, even one whose prefix starts with the other's. IDs returned
+	// by IDFromCookie are not checked. If it returns "", the store's prefix
+	// is used.
+	PrefixFunc func(r *http.Request) string
+	// IDFromCookie, if set, is given the raw value of the session cookie
+	// when the codecs fail to decode it, and returns the session ID. It
+	// allows cookies issued by another session library to keep working
+	// while Save issues cookies of this package.
+	IDFromCookie func(cookieValue string) (string, error)
+	// LegacyCookieName, if set, is the name of a cookie read by New when
+	// the request has no session cookie, e.g. the one set by another
+	// session library. Save only sets the session cookie.
+	LegacyCookieName string
+	// CookieTransform, if set, transforms the session ID inside the cookie,
+	// within the securecookie encoding. Changing it invalidates existing
+	// cookies. It is not applied to IDs returned by IDFromCookie.
+	CookieTransform CookieTransform
+	// CookieNameFunc, if set, returns the name of the cookie carrying the
+	// session with the given name, e.g. to use a fixed "__Host-" prefixed
+	// name whatever the session is called in code.
+	CookieNameFunc func(sessionName string) string
+	// Rand is the source of randomness for new session IDs. If nil,
+	// crypto/rand is used.
+	Rand io.Reader
+	// IDEncoding encodes the random bytes of new session IDs. If nil,
+	// base32.StdEncoding is used; base64.RawURLEncoding gives shorter IDs.
+	// Existing IDs stay valid when it changes.
+	IDEncoding IDEncoding
+	// Serializer encodes session values on save. If nil, GobSerializer is
+	// used. Values written with any registered serializer can be loaded.
+	Serializer Serializer
+	// Compressor, if set, compresses serialized values on save.
+	Compressor Compressor
+	// Transforms are applied in order to the serialized and compressed
+	// values on save, e.g. to encrypt them with an AESGCMTransform. Blobs
+	// are unwrapped on load according to their headers, whatever
+	// combination of steps wrote them, but a blob lacking the envelope of
+	// one of the Transforms is rejected as corrupt: adding a transform
+	// drops the sessions stored without it. Saves and loads fail if a tag
+	// is reserved, see Transform, or used by two of the Transforms.
+	Transforms []Transform
+	// Trace enables OpenCensus spans around datastore and memcache calls.
+	// Spans carry a truncated hash of the session ID, not the ID itself.
+	Trace bool
+	// BestEffortWrite makes Save log failed memcache writes and carry on
+	// instead of failing. The cookie is still set, so the session ID stays
+	// stable while its values may be lost. Use it for sessions that are not
+	// critical.
+	BestEffortWrite bool
+	// Cache, if set, is used in place of App Engine memcache.
+	Cache Cache
+	// CheckIDCollision makes Save add a session under a newly generated ID
+	// only if the key is not in use, and retry with another ID, rather than
+	// overwrite an unrelated session. Random IDs practically never collide,
+	// so this only guards against a broken Rand.
+	CheckIDCollision bool
+	// DiscardCorrupt makes New delete session data that cannot be decoded
+	// and return a fresh session instead of ErrCorruptSession.
+	DiscardCorrupt bool
+	// SkipEmptyNewSessions makes Save do nothing for a new session without
+	// values: no ID is generated, nothing is stored and no cookie is set.
+	// It saves work on anonymous and bot traffic.
+	SkipEmptyNewSessions bool
+	// TryAllCookies makes New try every cookie carrying the session name,
+	// using the first that decodes and refers to a stored session, instead
+	// of only the first cookie. It recovers sessions shadowed by a stale
+	// duplicate cookie sent by a buggy client or proxy.
+	TryAllCookies bool
+	// PersistEmpty makes Save store sessions without values, e.g. when an
+	// empty session is a meaningful state. By default such a save writes
+	// nothing and leaves any previously stored values in place. Either way,
+	// a session saved with a negative MaxAge, as on logout, is deleted only
+	// if PersistEmpty is set or it still has values, so clear the values
+	// and set PersistEmpty, or delete the stored session explicitly.
+	PersistEmpty bool
+	// OnlySetCookieOnNewID makes Save set the cookie only if the session is
+	// new, its ID changed or its options changed since it was loaded, to
+	// keep responses small. With a positive MaxAge the cookie's expiry in
+	// the browser is then no longer pushed back by every save.
+	OnlySetCookieOnNewID bool
+
 	Codecs                       []securecookie.Codec
 	Options                      *sessions.Options // default configuration
+	mu                           sync.RWMutex      // guards Codecs
 	prefix                       string
 	nonPersistentSessionDuration time.Duration
 }
 
-// Get returns a session for the given name after adding it to the registry.
+// RotateKeys atomically replaces the store's codecs with ones built from
+// keyPairs. Use it instead of assigning Codecs while requests are in flight.
+//
+// See NewCookieStore() for a description of keyPairs.
+func (s *MemcacheStore) RotateKeys(keyPairs ...[]byte) {
+	codecs := securecookie.CodecsFromPairs(keyPairs...)
+	s.mu.Lock()
+	s.Codecs = codecs
+	s.mu.Unlock()
+}
+
+// codecs returns the current codecs.
+func (s *MemcacheStore) codecs() []securecookie.Codec {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Codecs
+}
+
+// encoding returns the encoding used for stored session values.
+func (s *MemcacheStore) encoding() blobEncoding {
+	return blobEncoding{s.Serializer, s.Compressor, s.Transforms}
+}
+
+// Get returns a session for the given name after adding it to the registry,
+// which makes sessions.Save and Middleware save it. For a read-only check,
+// call New instead: it returns a session that is neither registered nor
+// shared with other Get calls of the request.
 //
 // See CookieStore.Get().
 func (s *MemcacheStore) Get(r *http.Request, name string) (*sessions.Session,
@@ -334,116 +2873,397 @@ func (s *MemcacheStore) Get(r *http.Request, name string) (*sessions.Session,
 // See CookieStore.New().
 func (s *MemcacheStore) New(r *http.Request, name string) (*sessions.Session,
 	error) {
-	session := sessions.NewSession(s, name)
+	if s.TryAllCookies {
+		return newFromEachCookie(r, name, cookieName(s.CookieNameFunc, name), s.newSession)
+	}
+	return s.newSession(r, name)
+}
+
+// newSession implements New for the first cookie with the given name.
+func (s *MemcacheStore) newSession(r *http.Request, name string) (*sessions.Session,
+	error) {
+	session := newSession(s, name)
 	opts := *s.Options
+	if s.Domain != "" {
+		opts.Domain = s.Domain
+	}
+	if s.Path != "" {
+		opts.Path = s.Path
+	}
 	session.Options = &opts
 	session.IsNew = true
-	var err error
-	if cookie, errCookie := r.Cookie(name); errCookie == nil {
-		err = securecookie.DecodeMulti(name, cookie.Value, &session.ID,
-			s.Codecs...)
-		if err == nil {
-			c := appengine.NewContext(r)
-			err = loadFromMemcache(c, session)
-			if err == nil {
-				session.IsNew = false
+	if cookie, errCookie := requestCookie(r, cookieName(s.CookieNameFunc, name), s.LegacyCookieName); errCookie == nil {
+		id, legacy, err := decodeCookieID(appengine.NewContext(r), cookie.Name, cookie.Value, s.IDFromCookie, s.CookieTransform, s.codecs())
+		if err != nil {
+			return session, fmt.Errorf("%w: %w", ErrCookieDecode, err)
+		}
+		if s.PrefixFunc != nil && !legacy && !s.ownsID(r, id) {
+			return session, nil
+		}
+		session.ID = id
+		c := appengine.NewContext(r)
+		mc, span := startSpan(c, s.Trace, "memcache.load", session.ID)
+		_, err = loadFromMemcache(mc, s.cache(), s.encoding(), session)
+		span.end(err)
+		if err != nil && s.DiscardCorrupt && errors.Is(err, ErrCorruptSession) {
+			logger(c).Warningf(c, "gaesessions: discarding session %s: %v", session.ID, err)
+			addOps(c, opMemcache, 1)
+			if err := s.cache().Delete(c, session.ID); err != nil && err != memcache.ErrCacheMiss {
+				return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
 			}
+			resetSession(session)
+			return session, nil
+		}
+		if isNotFound(err) {
+			resetSession(session)
+			setState(session, StateExpired)
+			return session, nil
 		}
+		if err != nil {
+			return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+		}
+		markLoaded(session)
 	}
-	return session, err
+	return session, nil
 }
 
 // Save adds a single session to the response.
 func (s *MemcacheStore) Save(r *http.Request, w http.ResponseWriter,
 	session *sessions.Session) error {
+	defer releaseMeta(session)
+	if s.SkipEmptyNewSessions && session.IsNew && len(session.Values) == 0 {
+		return nil
+	}
+	if savedUnchanged(session, s.encoding()) {
+		return nil
+	}
+	create := false
 	if session.ID == "" {
-		session.ID = s.prefix +
-			strings.TrimRight(
-				base32.StdEncoding.EncodeToString(
-					securecookie.GenerateRandomKey(32)), "=")
+		id, err := newSessionID(s.Rand, s.IDEncoding)
+		if err != nil {
+			return err
+		}
+		session.ID = s.prefixFor(r) + id
+		create = s.CheckIDCollision
 	}
-	c := appengine.NewContext(r)
-	if err := saveToMemcache(c, s.nonPersistentSessionDuration, session); err != nil {
+	c, span := startSpan(appengine.NewContext(r), s.Trace, "memcache.save", session.ID)
+	err := saveToMemcache(c, s.cache(), s.encoding(), s.nonPersistentSessionDuration, s.BestEffortWrite, create, s.PersistEmpty, session)
+	for attempt := 1; err == ErrIDCollision && attempt < idCollisionAttempts; attempt++ {
+		logger(c).Warningf(c, "gaesessions: session ID %s is taken, generating another", session.ID)
+		id, idErr := newSessionID(s.Rand, s.IDEncoding)
+		if idErr != nil {
+			err = idErr
+			break
+		}
+		session.ID = s.prefixFor(r) + id
+		err = saveToMemcache(c, s.cache(), s.encoding(), s.nonPersistentSessionDuration, s.BestEffortWrite, create, s.PersistEmpty, session)
+	}
+	span.end(err)
+	if err != nil {
+		return err
+	}
+	if s.OnlySetCookieOnNewID && cookieUnchanged(session) {
+		markSaved(c, session, s.encoding())
+		return nil
+	}
+	name := cookieName(s.CookieNameFunc, session.Name())
+	encoded, err := encodeCookieID(c, name, session.ID, s.CookieTransform, s.codecs())
+	if err != nil {
+		return err
+	}
+	cookie := sessions.NewCookie(name, encoded, session.Options)
+	if err := checkCookiePrefix(cookie); err != nil {
+		return err
+	}
+	if err := checkCookieLength(cookie, s.MaxCookieLength); err != nil {
+		return err
+	}
+	if err := setCookie(c, w, cookie); err != nil {
 		return err
 	}
-	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID,
-		s.Codecs...)
+	markSaved(c, session, s.encoding())
+	return nil
+}
+
+// GetAndDelete loads the session with the given ID and removes it from
+// memcache, so that of several concurrent calls only one gets the values,
+// e.g. to redeem a one-time token stored as a session. The item is first
+// replaced by an empty tombstone with compare-and-swap, which only one
+// caller can win, and then deleted. The returned session has StateLoaded and
+// IsNew set, since it is no longer stored. If the session is not cached, it
+// returns a fresh session with StateExpired.
+func (s *MemcacheStore) GetAndDelete(c context.Context, id string) (*sessions.Session, error) {
+	session := newSession(s, "")
+	opts := *s.Options
+	if s.Domain != "" {
+		opts.Domain = s.Domain
+	}
+	if s.Path != "" {
+		opts.Path = s.Path
+	}
+	session.Options = &opts
+	session.IsNew = true
+	session.ID = id
+	if err := contextErr(c, nil); err != nil {
+		return session, err
+	}
+	addOps(c, opMemcache, 1)
+	item, err := s.cache().Get(c, id)
+	if err == nil && len(item.Value) == 0 {
+		err = memcache.ErrCacheMiss // another caller's tombstone
+	}
+	if err == nil {
+		value := item.Value
+		item.Value = nil
+		item.Expiration = time.Minute
+		addOps(c, opMemcache, 1)
+		if err = s.cache().CompareAndSwap(c, item); err == memcache.ErrCASConflict || err == memcache.ErrNotStored {
+			err = memcache.ErrCacheMiss
+		}
+		item.Value = value
+	}
+	if err == memcache.ErrCacheMiss {
+		resetSession(session)
+		setState(session, StateExpired)
+		return session, nil
+	}
 	if err != nil {
+		return session, fmt.Errorf("%w: %w", ErrSessionLoad, contextErr(c, err))
+	}
+	addOps(c, opMemcache, 1)
+	if err := s.cache().Delete(c, id); err != nil && err != memcache.ErrCacheMiss {
+		logger(c).Warningf(c, "gaesessions: deleting tombstone of session %s: %v", id, err)
+	}
+	_, blob := splitCreated(item.Value)
+	if err := s.encoding().decode(session.ID, blob, &session.Values); err != nil {
+		return session, fmt.Errorf("%w: %w", ErrSessionLoad, err)
+	}
+	setState(session, StateLoaded)
+	return session, nil
+}
+
+// Expire removes the session with the given ID from memcache, e.g. to
+// revoke it. It succeeds if the session is not cached.
+//
+// See DatastoreStore.Expire().
+func (s *MemcacheStore) Expire(c context.Context, id string) error {
+	if err := contextErr(c, nil); err != nil {
+		return err
+	}
+	addOps(c, opMemcache, 1)
+	if err := s.cache().Delete(c, id); err != nil && err != memcache.ErrCacheMiss {
+		return contextErr(c, err)
+	}
+	return nil
+}
+
+// DeleteMulti removes the sessions with the given IDs from memcache in one
+// call, e.g. to clear sessions created by a test. IDs that are not cached are
+// ignored.
+func (s *MemcacheStore) DeleteMulti(c context.Context, ids ...string) error {
+	if err := contextErr(c, nil); err != nil || len(ids) == 0 {
 		return err
 	}
-	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded,
-		session.Options))
+	addOps(c, opMemcache, len(ids))
+	err := s.cache().DeleteMulti(c, ids)
+	if merr, ok := err.(appengine.MultiError); ok {
+		for _, err := range merr {
+			if err != nil && err != memcache.ErrCacheMiss {
+				return contextErr(c, err)
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return contextErr(c, err)
+	}
 	return nil
 }
 
-// save writes encoded session.Values to memcache.
-func saveToMemcache(c context.Context,
-	nonPersistentSessionDuration time.Duration,
+// cache returns the store's Cache, App Engine memcache by default.
+func (s *MemcacheStore) cache() Cache {
+	if s.Cache != nil {
+		return s.Cache
+	}
+	return appEngineCache{}
+}
+
+// prefixFor returns the memcache key prefix used for sessions of r.
+func (s *MemcacheStore) prefixFor(r *http.Request) string {
+	if s.PrefixFunc != nil {
+		if prefix := s.PrefixFunc(r); prefix != "" {
+			return prefix
+		}
+	}
+	return s.prefix
+}
+
+// ownsID reports whether id was generated by Save for a request like r: it
+// must be r's prefix followed by exactly one generated ID, so that the
+// sessions of a tenant whose prefix starts with r's prefix are not accepted.
+func (s *MemcacheStore) ownsID(r *http.Request, id string) bool {
+	prefix := s.prefixFor(r)
+	return strings.HasPrefix(id, prefix) && len(id)-len(prefix) == sessionIDLen(s.IDEncoding)
+}
+
+// Exists reports whether a session with the given ID is in memcache.
+func (s *MemcacheStore) Exists(c context.Context, id string) (bool, error) {
+	return existsInMemcache(c, s.cache(), id)
+}
+
+// save writes encoded session.Values to memcache. If bestEffort is true,
+// failures of memcache itself are logged and otherwise ignored. If create is
+// true, the session is only added if its key is not in use, and
+// ErrIDCollision is returned otherwise.
+func saveToMemcache(c context.Context, cache Cache, enc blobEncoding,
+	nonPersistentSessionDuration time.Duration, bestEffort, create, persistEmpty bool,
 	session *sessions.Session) error {
-	if len(session.Values) == 0 {
+	if !persistEmpty && len(session.Values) == 0 {
 		// Don't need to write anything.
 		return nil
 	}
-	serialized, err := serialize(session.Values)
+	serialized, err := enc.encode(session.ID, session.Values)
 	if err != nil {
 		return err
 	}
-	var expiration time.Duration
-	if session.Options.MaxAge > 0 {
-		expiration = time.Duration(session.Options.MaxAge) * time.Second
-	} else {
-		expiration = nonPersistentSessionDuration
+	if m := peekMeta(session); m != nil {
+		serialized = withCreated(m.created, serialized)
+	}
+	if n := len(session.ID) + len(serialized); n > maxMemcacheItemSize-memcacheItemOverhead {
+		return fmt.Errorf("%w: %d bytes, limit %d", ErrValueTooLarge, n, maxMemcacheItemSize-memcacheItemOverhead)
 	}
+	expiration := sessionExpiration(session.Options, nonPersistentSessionDuration)
+	if err := contextErr(c, nil); err != nil {
+		return err
+	}
+	// App Engine memcache only reads expirations of 30 years or more as
+	// absolute times, so a MaxAge beyond memcached's 30 days is passed as is.
 	if expiration > 0 {
-		log.Debugf(c, "MemcacheStore.save. session.ID=%s, expiration=%s",
+		logger(c).Debugf(c, "MemcacheStore.save. session.ID=%s, expiration=%s",
 			session.ID, expiration)
-		err = memcache.Set(c, &memcache.Item{
+		item := &memcache.Item{
 			Key:        session.ID,
 			Value:      serialized,
+			Flags:      cachedAtFlags(),
 			Expiration: expiration,
-		})
+		}
+		addOps(c, opMemcache, 1)
+		if create {
+			if err = cache.Add(c, item); err == memcache.ErrNotStored {
+				return ErrIDCollision
+			}
+		} else {
+			err = cache.Set(c, item)
+		}
 		if err != nil {
-			return err
+			return memcacheWriteErr(c, bestEffort, session.ID, err)
 		}
 	} else {
-		err = memcache.Delete(c, session.ID)
+		addOps(c, opMemcache, 1)
+		err = cache.Delete(c, session.ID)
 		if err != nil {
-			return err
+			return memcacheWriteErr(c, bestEffort, session.ID, err)
 		}
-		log.Debugf(c, "MemcacheStore.save. delete session.ID=%s", session.ID)
+		logger(c).Debugf(c, "MemcacheStore.save. delete session.ID=%s", session.ID)
 	}
 	return nil
 }
 
-// load gets a value from memcache and decodes its content into session.Values.
-func loadFromMemcache(c context.Context, session *sessions.Session) error {
-	item, err := memcache.Get(c, session.ID)
-	if err != nil {
-		return err
+// formatCreated starts the value of a memcache item that carries the
+// creation time of its session ahead of the stored blob, as
+//
+//	formatCreated | Unix time in nanoseconds (8 bytes, big endian) | blob
+//
+// so that MemcacheDatastoreStore can keep Session.Created when it saves a
+// session it loaded from memcache. Items without it hold the blob alone.
+const (
+	formatCreated byte = 0xff
+
+	createdHeaderLen = 9
+)
+
+// withCreated prefixes blob with created, unless created is zero.
+func withCreated(created time.Time, blob []byte) []byte {
+	if created.IsZero() {
+		return blob
 	}
-	if err := deserialize(item.Value, &session.Values); err != nil {
-		return err
+	b := make([]byte, createdHeaderLen, createdHeaderLen+len(blob))
+	b[0] = formatCreated
+	binary.BigEndian.PutUint64(b[1:], uint64(created.UnixNano()))
+	return append(b, blob...)
+}
+
+// splitCreated returns the creation time carried by the value of a memcache
+// item, or zero if it carries none, and the blob that follows it.
+func splitCreated(value []byte) (time.Time, []byte) {
+	if len(value) < createdHeaderLen || value[0] != formatCreated {
+		return time.Time{}, value
 	}
-	return nil
+	return time.Unix(0, int64(binary.BigEndian.Uint64(value[1:]))), value[createdHeaderLen:]
 }
 
-// Serialization --------------------------------------------------------------
+// maxMemcacheItemSize is the largest item memcache stores, counting its key,
+// its value and memcacheItemOverhead bytes of bookkeeping. Larger items make
+// Set fail with an unhelpful error.
+const (
+	maxMemcacheItemSize  = 1 << 20
+	memcacheItemOverhead = 73
+)
+
+// memcacheWriteErr returns the error saveToMemcache reports for a failed
+// memcache write: nil after logging it if bestEffort is true and c is still
+// live, and err otherwise.
+func memcacheWriteErr(c context.Context, bestEffort bool, id string, err error) error {
+	if err = contextErr(c, err); bestEffort && !errors.Is(err, ErrCanceled) {
+		logger(c).Warningf(c, "gaesessions: ignoring failed memcache write of session %s: %v", id, err)
+		return nil
+	}
+	return err
+}
 
-// serialize encodes a value using gob.
-func serialize(src interface{}) ([]byte, error) {
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	if err := enc.Encode(src); err != nil {
-		return nil, err
+// existsInMemcache reports whether a session with the given ID is in memcache.
+func existsInMemcache(c context.Context, cache Cache, id string) (bool, error) {
+	if err := contextErr(c, nil); err != nil {
+		return false, err
+	}
+	addOps(c, opMemcache, 1)
+	if _, err := cache.Get(c, id); err != nil {
+		if err == memcache.ErrCacheMiss {
+			return false, nil
+		}
+		return false, contextErr(c, err)
 	}
-	return buf.Bytes(), nil
+	return true, nil
 }
 
-// deserialize decodes a value using gob.
-func deserialize(src []byte, dst interface{}) error {
-	dec := gob.NewDecoder(bytes.NewBuffer(src))
-	if err := dec.Decode(dst); err != nil {
-		return err
+// load gets a value from memcache and decodes its content into
+// session.Values. It returns when the item was written, which is the zero
+// time for items written without cachedAtFlags.
+func loadFromMemcache(c context.Context, cache Cache, enc blobEncoding,
+	session *sessions.Session) (time.Time, error) {
+	if err := contextErr(c, nil); err != nil {
+		return time.Time{}, err
 	}
-	return nil
+	addOps(c, opMemcache, 1)
+	item, err := cache.Get(c, session.ID)
+	if err != nil {
+		return time.Time{}, contextErr(c, err)
+	}
+	created, blob := splitCreated(item.Value)
+	if err := enc.decode(session.ID, blob, &session.Values); err != nil {
+		return time.Time{}, err
+	}
+	if !created.IsZero() {
+		metaOf(session).created = created
+	}
+	if item.Flags == 0 {
+		return time.Time{}, nil
+	}
+	return time.Unix(int64(item.Flags), 0), nil
+}
+
+// cachedAtFlags returns the memcache item flags recording that the item was
+// written now, as Unix seconds. See StaleWhileRevalidate.
+func cachedAtFlags() uint32 {
+	return uint32(time.Now().Unix())
 }
@@ -0,0 +1,378 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/memcache"
+)
+
+// testRequest returns a request carrying cookies whose context makes the
+// stores log nowhere, as they are not running on App Engine.
+func testRequest(cookies ...*http.Cookie) *http.Request {
+	r := httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	return r.WithContext(WithLogger(r.Context(), discardLogger{}))
+}
+
+// newTestMemcacheStore returns a MemcacheStore backed by a mapCache.
+func newTestMemcacheStore() (*MemcacheStore, *mapCache) {
+	cache := newMapCache()
+	store := NewMemcacheStore("", 0, []byte("0123456789abcdef0123456789abcdef"))
+	store.Cache = cache
+	return store, cache
+}
+
+func TestExpiredBoundary(t *testing.T) {
+	for _, grace := range []time.Duration{0, 5 * time.Second} {
+		// The cleanup queries delete sessions with an ExpirationDate at or
+		// before expiredBefore(grace); a load must reject exactly those.
+		boundary := expiredBefore(grace)
+		if !expired(boundary, grace) {
+			t.Errorf("grace %v: session expiring at the cleanup boundary is not expired", grace)
+		}
+		if !expired(boundary.Add(-time.Nanosecond), grace) {
+			t.Errorf("grace %v: session expiring before the cleanup boundary is not expired", grace)
+		}
+		if expired(boundary.Add(time.Minute), grace) {
+			t.Errorf("grace %v: session expiring after the cleanup boundary is expired", grace)
+		}
+	}
+
+	// A session that expired a moment ago is kept within the grace period.
+	justExpired := time.Now().Add(-time.Second)
+	if !expired(justExpired, 0) {
+		t.Error("session that expired a second ago is not expired without grace")
+	}
+	if expired(justExpired, 5*time.Second) {
+		t.Error("session that expired a second ago is expired despite a 5s grace")
+	}
+}
+
+func TestMemcacheStoreLegacyCookie(t *testing.T) {
+	values := map[interface{}]interface{}{"user": "gopher"}
+	for _, tenants := range []bool{false, true} {
+		store, cache := newTestMemcacheStore()
+		store.LegacyCookieName = "legacy_sid"
+		store.IDFromCookie = func(cookieValue string) (string, error) { return cookieValue, nil }
+		if tenants {
+			store.PrefixFunc = func(r *http.Request) string { return "tenant-a." }
+		}
+		blob, err := store.encoding().encode("legacy-123", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.items["legacy-123"] = memcache.Item{Key: "legacy-123", Value: blob}
+
+		session, err := store.New(testRequest(&http.Cookie{Name: "legacy_sid", Value: "legacy-123"}), "session")
+		if err != nil {
+			t.Fatalf("PrefixFunc set %v: New with a legacy cookie: %v", tenants, err)
+		}
+		if session.IsNew || session.ID != "legacy-123" || !reflect.DeepEqual(session.Values, values) {
+			t.Fatalf("PrefixFunc set %v: New with a legacy cookie returned IsNew %v, ID %q, values %v",
+				tenants, session.IsNew, session.ID, session.Values)
+		}
+	}
+}
+
+func TestMemcacheStoreTenantPrefix(t *testing.T) {
+	store, _ := newTestMemcacheStore()
+	tenant := "a.b."
+	store.PrefixFunc = func(r *http.Request) string { return tenant }
+	cookie := saveCookie(t, store, map[interface{}]interface{}{"user": "gopher"})
+
+	if session, err := store.New(testRequest(cookie), "session"); err != nil || session.IsNew {
+		t.Fatalf("New for the same tenant returned IsNew %v, error %v", session.IsNew, err)
+	}
+	// "a." is a prefix of "a.b.", but the session is not tenant a.'s.
+	tenant = "a."
+	session, err := store.New(testRequest(cookie), "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !session.IsNew || len(session.Values) != 0 {
+		t.Fatalf("New for another tenant returned IsNew %v and values %v", session.IsNew, session.Values)
+	}
+}
+
+func TestCreatedHeader(t *testing.T) {
+	blob := []byte{FormatGob, 1, 2, 3}
+	if got := withCreated(time.Time{}, blob); !reflect.DeepEqual(got, blob) {
+		t.Fatalf("withCreated of a zero time changed the blob to %v", got)
+	}
+	created := time.Unix(1700000000, 123)
+	gotCreated, gotBlob := splitCreated(withCreated(created, blob))
+	if !gotCreated.Equal(created) || !reflect.DeepEqual(gotBlob, blob) {
+		t.Fatalf("splitCreated returned %v and %v, want %v and %v", gotCreated, gotBlob, created, blob)
+	}
+	if gotCreated, gotBlob := splitCreated(blob); !gotCreated.IsZero() || !reflect.DeepEqual(gotBlob, blob) {
+		t.Fatalf("splitCreated of a bare blob returned %v and %v", gotCreated, gotBlob)
+	}
+}
+
+func TestPropertiesTooLongToIndex(t *testing.T) {
+	long := strings.Repeat("x", maxIndexedStringLen)
+	labels := labelProperties(map[string]string{"channel": "mobile", "referrer": long})
+	if !reflect.DeepEqual(labels, []string{"channel=mobile"}) {
+		t.Errorf("labelProperties kept %d labels, want only channel=mobile", len(labels))
+	}
+
+	fits := strings.Repeat("y", maxIndexedStringLen-len("k="))
+	values := map[interface{}]interface{}{"k": fits, "long": long, "user": "gopher"}
+	indexed := indexedProperties(values, []string{"k", "long", "user"})
+	want := []string{"k=" + fits, "user=gopher"}
+	if !reflect.DeepEqual(indexed, want) {
+		t.Errorf("indexedProperties kept %d values, want %d", len(indexed), len(want))
+	}
+	for _, p := range indexed {
+		if len(p) > maxIndexedStringLen {
+			t.Errorf("indexed property of %d bytes exceeds the datastore limit", len(p))
+		}
+	}
+}
+
+func TestPropertyEscapesName(t *testing.T) {
+	if a, b := property("a=b", "c"), property("a", "b=c"); a == b {
+		t.Fatalf("property of a=b/c and a/b=c are both %q", a)
+	}
+}
+
+func TestExtendEntity(t *testing.T) {
+	grace := 5 * time.Second
+	now := time.Now()
+	for _, tc := range []struct {
+		name    string
+		entity  Session
+		legacy  time.Duration
+		wantErr error
+	}{
+		{"Live", Session{ExpirationDate: now.Add(time.Minute)}, 0, nil},
+		{"WithinGrace", Session{ExpirationDate: now.Add(-time.Second)}, 0, nil},
+		{"Expired", Session{ExpirationDate: now.Add(-time.Minute)}, 0, ErrSessionExpired},
+		{"NoExpirationDate", Session{Date: now}, 0, ErrSessionExpired},
+		{"LegacyLive", Session{Date: now}, time.Hour, nil},
+		{"LegacyExpired", Session{Date: now.Add(-2 * time.Hour)}, time.Hour, ErrSessionExpired},
+	} {
+		entity := tc.entity
+		err := extendEntity(&entity, grace, tc.legacy, time.Hour)
+		if err != tc.wantErr {
+			t.Errorf("%s: extendEntity returned %v, want %v", tc.name, err, tc.wantErr)
+			continue
+		}
+		if err == nil && entity.ExpirationDate.Before(now.Add(59*time.Minute)) {
+			t.Errorf("%s: extendEntity moved the expiration date to %v, want an hour from now", tc.name, entity.ExpirationDate)
+		}
+		if err != nil && !entity.ExpirationDate.Before(now) {
+			t.Errorf("%s: extendEntity revived an expired session until %v", tc.name, entity.ExpirationDate)
+		}
+	}
+}
+
+func TestExpiredQueries(t *testing.T) {
+	store := NewDatastoreStore("Session", 0)
+	store.ShardCount = 2
+	store.ExpirationGracePeriod = time.Minute
+	before := expiredBefore(store.ExpirationGracePeriod)
+	labels := map[string]string{"channel": "mobile"}
+
+	// RemoveExpiredDryRun counts the keys selected by the very queries
+	// removeExpired deletes, so they must cover every shard and honor the
+	// grace period and labels.
+	want := []*datastore.Query{
+		datastore.NewQuery("Session_0").Filter("ExpirationDate <=", before).Filter("Labels =", "channel=mobile"),
+		datastore.NewQuery("Session_1").Filter("ExpirationDate <=", before).Filter("Labels =", "channel=mobile"),
+	}
+	if got := store.expiredQueries(labels, before); !reflect.DeepEqual(got, want) {
+		t.Fatalf("expiredQueries returned %+v, want %+v", got, want)
+	}
+}
+
+func TestSaveWithOptionsThenSave(t *testing.T) {
+	store, _ := newTestMemcacheStore()
+	r := testRequest()
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["user"] = "gopher"
+	opts := *session.Options
+	opts.Domain = "example.com"
+	w := httptest.NewRecorder()
+	if err := SaveWithOptions(r, w, session, &opts); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Domain != "example.com" {
+		t.Fatalf("SaveWithOptions set %v, want a cookie for example.com", cookies)
+	}
+	if session.Options.Domain != "" {
+		t.Fatal("SaveWithOptions left the overriding options on the session")
+	}
+
+	// Middleware saves every registered session once the handler is done;
+	// that must not replace the cookie with one for the request's host.
+	w = httptest.NewRecorder()
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("Save after SaveWithOptions set %v, want no cookie", cookies)
+	}
+
+	session.Values["user"] = "gordon"
+	w = httptest.NewRecorder()
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].Domain != "" {
+		t.Fatalf("Save of a changed session set %v, want a cookie with the session's options", cookies)
+	}
+}
+
+func TestMemcacheItemSizeLimit(t *testing.T) {
+	c := testRequest().Context()
+	store, cache := newTestMemcacheStore()
+	enc := store.encoding()
+	limit := maxMemcacheItemSize - memcacheItemOverhead
+	session := newSession(store, "session")
+	session.ID = "id"
+	// itemSize returns the key and value size of the session holding n bytes.
+	itemSize := func(n int) int {
+		session.Values["v"] = strings.Repeat("x", n)
+		blob, err := enc.encode(session.ID, session.Values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(session.ID) + len(withCreated(metaOf(session).created, blob))
+	}
+	n := limit - itemSize(limit-100) + limit - 100
+	if size := itemSize(n); size != limit {
+		t.Fatalf("session of %d bytes is %d, want %d", n, size, limit)
+	}
+	if err := saveToMemcache(c, cache, enc, 0, false, false, false, session); err != nil {
+		t.Fatalf("save of an item at the limit: %v", err)
+	}
+	if itemSize(n+1) != limit+1 {
+		t.Fatal("growing the value by one byte did not grow the item by one")
+	}
+	if err := saveToMemcache(c, cache, enc, 0, false, false, false, session); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("save of an item a byte over the limit returned %v, want ErrValueTooLarge", err)
+	}
+}
+
+func TestWarmItem(t *testing.T) {
+	grace := time.Minute
+	now := time.Now()
+	for _, tc := range []struct {
+		name       string
+		expiration time.Time
+		want       bool
+	}{
+		{"Live", now.Add(time.Hour), true},
+		{"WithinGrace", now.Add(-30 * time.Second), true},
+		{"Expired", now.Add(-2 * time.Minute), false},
+		{"LastSecond", now.Add(-grace + 500*time.Millisecond), false},
+	} {
+		item := warmItem("id", Session{ExpirationDate: tc.expiration, Value: []byte{FormatGob}}, grace)
+		if (item != nil) != tc.want {
+			t.Errorf("%s: warmItem returned %v, want an item %v", tc.name, item, tc.want)
+			continue
+		}
+		if item != nil && (item.Expiration < time.Second || item.Expiration > tc.expiration.Add(grace).Sub(now)) {
+			t.Errorf("%s: item expires in %v, want by the end of the grace period", tc.name, item.Expiration)
+		}
+	}
+}
+
+func TestDetachedContext(t *testing.T) {
+	parent, cancel := context.WithCancel(WithLogger(context.Background(), discardLogger{}))
+	c, stop := context.WithTimeout(detachedContext{parent}, time.Hour)
+	defer stop()
+	cancel()
+	if err := c.Err(); err != nil {
+		t.Fatalf("cancelling the request context cancelled the detached one: %v", err)
+	}
+	if _, ok := logger(c).(discardLogger); !ok {
+		t.Fatal("detached context lost the values of the request context")
+	}
+	if _, ok := c.Deadline(); !ok {
+		t.Fatal("detached context ignored its own timeout")
+	}
+}
+
+func TestMemcacheDatastoreStoreMixedFormats(t *testing.T) {
+	zstd, err := NewZstdCompressor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gob := blobEncoding{serializer: GobSerializer{}}
+	compact := blobEncoding{serializer: CompactSerializer{}, compressor: zstd}
+	json := blobEncoding{serializer: JSONSerializer{}}
+	values := map[interface{}]interface{}{"user": "gopher", "admin": true}
+	created := time.Unix(1700000000, 0)
+	// Instances configured without the compressor read its blobs once it is
+	// registered.
+	RegisterCompressor(zstd)
+	t.Cleanup(func() {
+		compressorsMu.Lock()
+		delete(compressors, AlgorithmZstd)
+		compressorsMu.Unlock()
+	})
+
+	// During a rollout of a new format, memcache and the datastore may each
+	// hold a blob written by an instance with either configuration.
+	for _, tc := range []struct {
+		name                     string
+		store, cached, datastore blobEncoding
+	}{
+		{"GobCachedCompactStored", compact, gob, compact},
+		{"GobCachedJSONStored", json, gob, json},
+		{"CompactCachedGobStored", gob, compact, gob},
+		{"CompactCachedJSONStored", gob, compact, json},
+	} {
+		store := NewMemcacheDatastoreStore("", "", 0, conformanceKey)
+		store.Serializer, store.Compressor = tc.store.serializer, tc.store.compressor
+		enc := store.encoding()
+
+		cache := newMapCache()
+		blob, err := tc.cached.encode("id", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.items["id"] = memcache.Item{Key: "id", Value: withCreated(created, blob)}
+		session := newSession(store, "session")
+		session.ID = "id"
+		if _, err := loadFromMemcache(testRequest().Context(), cache, enc, session); err != nil {
+			t.Fatalf("%s: loading the cached blob: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(session.Values, values) || !metaOf(session).created.Equal(created) {
+			t.Fatalf("%s: loaded %v created %v from memcache, want %v created %v",
+				tc.name, session.Values, metaOf(session).created, values, created)
+		}
+
+		// loadFromDatastore decodes the entity's blob the same way.
+		blob, err = tc.datastore.encode("id", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[interface{}]interface{}
+		if err := enc.decode("id", blob, &got); err != nil {
+			t.Fatalf("%s: decoding the stored blob: %v", tc.name, err)
+		}
+		if !reflect.DeepEqual(got, values) {
+			t.Fatalf("%s: decoded %v from the datastore, want %v", tc.name, got, values)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+
+	"github.com/gorilla/sessions"
+)
+
+// ShadowStore ----------------------------------------------------------------
+
+// NewShadowStore returns a new ShadowStore that reads from primary, falls back
+// to secondary, and writes to primary only.
+func NewShadowStore(primary, secondary sessions.Store) *ShadowStore {
+	return &ShadowStore{
+		Primary:   primary,
+		Secondary: secondary,
+	}
+}
+
+// ShadowStore eases moving sessions from one store to another, e.g. from
+// MemcacheStore to DatastoreStore, without logging users out.
+//
+// Sessions are looked up in Primary first and, if not found there, in
+// Secondary. Sessions are always saved to Primary, so a session read from
+// Secondary moves over the next time it is saved. Both stores must be able to
+// decode each other's cookies, i.e. use the same key pairs.
+type ShadowStore struct {
+	Primary   sessions.Store
+	Secondary sessions.Store
+	// CopyOnRead, if set, saves a session found only in Secondary to Primary
+	// as soon as it is read, without setting a cookie.
+	CopyOnRead bool
+}
+
+var _ sessions.Store = (*ShadowStore)(nil)
+
+// Get returns a session for the given name after adding it to the registry,
+// which makes sessions.Save and Middleware save it. For a read-only check,
+// call New instead: it returns a session that is neither registered nor
+// shared with other Get calls of the request.
+//
+// See CookieStore.Get().
+func (s *ShadowStore) Get(r *http.Request, name string) (*sessions.Session,
+	error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the registry.
+//
+// See CookieStore.New().
+func (s *ShadowStore) New(r *http.Request, name string) (*sessions.Session,
+	error) {
+	found, err := s.Primary.New(r, name)
+	if err != nil || !found.IsNew {
+		return s.wrap(name, found, true), err
+	}
+	found, err = s.Secondary.New(r, name)
+	if err != nil || found.IsNew {
+		return s.wrap(name, found, false), err
+	}
+	if s.CopyOnRead {
+		c := WithoutCookie(r.Context())
+		copied := copySession(s.Primary, name, found)
+		if err := s.Primary.Save(r.WithContext(c), nopResponseWriter{}, copied); err != nil {
+			return s.wrap(name, found, false), err
+		}
+		copied.IsNew = false
+		return s.wrap(name, copied, true), nil
+	}
+	return s.wrap(name, found, false), nil
+}
+
+// Save adds a single session to the response, saving it to Primary.
+func (s *ShadowStore) Save(r *http.Request, w http.ResponseWriter,
+	session *sessions.Session) error {
+	return s.Primary.Save(r, w, session)
+}
+
+// wrap returns a session of the shadow store holding the state of found, so
+// that saving it through the registry goes through the shadow store. Unless
+// found is stored in Primary, only its state is kept from its metadata: the
+// rest, e.g. the version, describes the session as stored in Secondary, and
+// would make Primary reject or skip saving it.
+func (s *ShadowStore) wrap(name string, found *sessions.Session, inPrimary bool) *sessions.Session {
+	session := newSession(s, name)
+	if found != nil {
+		session.ID = found.ID
+		session.Values = found.Values
+		if m := peekMeta(found); m != nil {
+			if inPrimary {
+				*metaOf(session) = *m
+			} else {
+				setState(session, m.state)
+			}
+		}
+		session.Options = found.Options
+		session.IsNew = found.IsNew
+	}
+	return session
+}
+
+// Copy loads the session with the given name from one store and saves it,
+// under the same ID and with the same values, to another, e.g. to migrate
+// sessions to a new backend as they are used. Nothing is saved if the
+// request carries no session found in from. The cookie set by to is added to
+// w; the session in from is left in place. The stores are called with r
+// carrying c as its context.
+func Copy(c context.Context, from, to sessions.Store, r *http.Request,
+	w http.ResponseWriter, name string) error {
+	r = r.WithContext(c)
+	src, err := from.New(r, name)
+	if err != nil || src.IsNew {
+		return err
+	}
+	return to.Save(r, w, copySession(to, name, src))
+}
+
+// copySession returns a new session of store with the ID, values and options
+// of src, to be saved to store. The metadata of src, e.g. its version,
+// describes the session as stored in its own store, and would make store
+// reject or skip the save, so it is left out. The copy is new, so that
+// store does not rotate its ID either.
+func copySession(store sessions.Store, name string, src *sessions.Session) *sessions.Session {
+	dst := newSession(store, name)
+	dst.ID = src.ID
+	for k, v := range src.Values {
+		dst.Values[k] = v
+	}
+	if src.Options != nil {
+		opts := *src.Options
+		dst.Options = &opts
+	}
+	return dst
+}
+
+// nopResponseWriter discards everything written to it.
+type nopResponseWriter struct{}
+
+func (nopResponseWriter) Header() http.Header         { return http.Header{} }
+func (nopResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (nopResponseWriter) WriteHeader(int)             {}
@@ -0,0 +1,34 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestShadowStoreCopyOnRead(t *testing.T) {
+	primary, secondary := NewMapStore(0, conformanceKey), NewMapStore(0, conformanceKey)
+	values := map[interface{}]interface{}{"user": "gopher"}
+	cookie := saveCookie(t, secondary, values)
+
+	store := NewShadowStore(primary, secondary)
+	store.CopyOnRead = true
+	session, err := store.New(testRequest(cookie), "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.IsNew || !reflect.DeepEqual(session.Values, values) {
+		t.Fatalf("New returned IsNew %v and values %v", session.IsNew, session.Values)
+	}
+
+	copied, err := primary.New(testRequest(cookie), "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.IsNew || !reflect.DeepEqual(copied.Values, values) {
+		t.Fatalf("Primary holds IsNew %v and values %v after CopyOnRead", copied.IsNew, copied.Values)
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"sync/atomic"
+)
+
+// Size statistics ------------------------------------------------------------
+
+// sizeBucketCount is the number of buckets in a size histogram: powers of
+// two from 256 bytes up to the datastore's 1 MiB entity limit, plus one for
+// anything larger.
+const sizeBucketCount = 14
+
+// SizeBucket counts the sessions saved with a serialized size of at most
+// UpTo bytes and more than the UpTo of the previous bucket. The UpTo of the
+// last bucket is 0 and means no limit.
+type SizeBucket struct {
+	UpTo  int
+	Count int64
+}
+
+// SizeStats is a snapshot of the sizes of the serialized sessions a store
+// has saved since it was created.
+type SizeStats struct {
+	Count   int64 // number of saves recorded
+	Max     int   // largest size recorded, in bytes
+	Buckets []SizeBucket
+}
+
+// sizeHistogram records serialized session sizes without locking.
+type sizeHistogram struct {
+	count   atomic.Int64
+	max     atomic.Int64
+	buckets [sizeBucketCount]atomic.Int64
+}
+
+// sizeBucketLimit returns the UpTo of bucket i.
+func sizeBucketLimit(i int) int {
+	if i == sizeBucketCount-1 {
+		return 0
+	}
+	return 256 << i
+}
+
+// record adds a save of n bytes.
+func (h *sizeHistogram) record(n int) {
+	i := 0
+	for i < sizeBucketCount-1 && n > sizeBucketLimit(i) {
+		i++
+	}
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	for max := h.max.Load(); int64(n) > max; max = h.max.Load() {
+		if h.max.CompareAndSwap(max, int64(n)) {
+			break
+		}
+	}
+}
+
+// snapshot returns the current statistics. Buckets are read one at a time,
+// so the snapshot may be slightly inconsistent under concurrent saves.
+func (h *sizeHistogram) snapshot() SizeStats {
+	stats := SizeStats{
+		Count:   h.count.Load(),
+		Max:     int(h.max.Load()),
+		Buckets: make([]SizeBucket, sizeBucketCount),
+	}
+	for i := range stats.Buckets {
+		stats.Buckets[i] = SizeBucket{UpTo: sizeBucketLimit(i), Count: h.buckets[i].Load()}
+	}
+	return stats
+}
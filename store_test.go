@@ -0,0 +1,132 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// conformanceKey is the key pair given to the stores under test.
+var conformanceKey = []byte("0123456789abcdef0123456789abcdef")
+
+// loadCookie calls New on store for a request carrying cookie.
+func loadCookie(store sessions.Store, cookie *http.Cookie) (*sessions.Session, error) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	return store.New(r, "session")
+}
+
+// testStoreConformance checks the behavior every store of the package must
+// share. newStore returns an empty store that keeps sessions saved with a
+// MaxAge of zero for nonPersistent.
+func testStoreConformance(t *testing.T, newStore func(nonPersistent time.Duration) sessions.Store) {
+	t.Run("RoundTrip", func(t *testing.T) {
+		store := newStore(0)
+		session, err := store.New(httptest.NewRequest("GET", "/", nil), "session")
+		if err != nil {
+			t.Fatalf("New without a cookie: %v", err)
+		}
+		if !session.IsNew || len(session.Values) != 0 {
+			t.Fatalf("New without a cookie returned IsNew %v and values %v", session.IsNew, session.Values)
+		}
+
+		values := map[interface{}]interface{}{"user": "gopher", "visits": 3}
+		cookie := saveCookie(t, store, values)
+		got, err := loadCookie(store, cookie)
+		if err != nil {
+			t.Fatalf("New with the saved cookie: %v", err)
+		}
+		if got.IsNew {
+			t.Fatal("New with the saved cookie returned a new session")
+		}
+		if !reflect.DeepEqual(got.Values, values) {
+			t.Fatalf("New with the saved cookie returned %v, want %v", got.Values, values)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		store := newStore(0)
+		cookie := saveCookie(t, store, map[interface{}]interface{}{"user": "gopher"})
+		session, err := loadCookie(store, cookie)
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.Options.MaxAge = -1
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		if err := store.Save(r, w, session); err != nil {
+			t.Fatalf("Save with a negative MaxAge: %v", err)
+		}
+		if cookies := w.Result().Cookies(); len(cookies) != 1 || cookies[0].MaxAge >= 0 {
+			t.Fatalf("Save with a negative MaxAge set %v, want an expired cookie", cookies)
+		}
+		got, err := loadCookie(store, cookie)
+		if err != nil {
+			t.Fatalf("New after delete: %v", err)
+		}
+		if !got.IsNew || len(got.Values) != 0 {
+			t.Fatalf("New after delete returned IsNew %v and values %v", got.IsNew, got.Values)
+		}
+	})
+
+	t.Run("Expiration", func(t *testing.T) {
+		store := newStore(10 * time.Millisecond)
+		r := httptest.NewRequest("GET", "/", nil)
+		session, err := store.New(r, "session")
+		if err != nil {
+			t.Fatal(err)
+		}
+		session.Values["user"] = "gopher"
+		session.Options.MaxAge = 0
+		w := httptest.NewRecorder()
+		if err := store.Save(r, w, session); err != nil {
+			t.Fatal(err)
+		}
+		cookie := w.Result().Cookies()[0]
+		if got, err := loadCookie(store, cookie); err != nil || got.IsNew {
+			t.Fatalf("New before expiration returned IsNew %v, error %v", got.IsNew, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+		got, err := loadCookie(store, cookie)
+		if err != nil {
+			t.Fatalf("New after expiration: %v", err)
+		}
+		if !got.IsNew || len(got.Values) != 0 {
+			t.Fatalf("New after expiration returned IsNew %v and values %v", got.IsNew, got.Values)
+		}
+	})
+
+	t.Run("TamperedCookie", func(t *testing.T) {
+		store := newStore(0)
+		cookie := saveCookie(t, store, map[interface{}]interface{}{"user": "gopher"})
+		cookie.Value = "x" + cookie.Value
+		got, err := loadCookie(store, cookie)
+		if !errors.Is(err, ErrCookieDecode) {
+			t.Fatalf("New with a tampered cookie returned error %v, want ErrCookieDecode", err)
+		}
+		if got == nil || !got.IsNew || len(got.Values) != 0 {
+			t.Fatalf("New with a tampered cookie returned %v, want a new session", got)
+		}
+	})
+}
+
+func TestMapStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(nonPersistent time.Duration) sessions.Store {
+		return NewMapStore(nonPersistent, conformanceKey)
+	})
+}
+
+func TestShadowStoreConformance(t *testing.T) {
+	testStoreConformance(t, func(nonPersistent time.Duration) sessions.Store {
+		return NewShadowStore(NewMapStore(nonPersistent, conformanceKey), NewMapStore(nonPersistent, conformanceKey))
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"go.opencensus.io/trace"
+	"golang.org/x/net/context"
+)
+
+// Tracing --------------------------------------------------------------------
+
+// span is a trace span around a single session I/O operation. A nil *span is
+// valid and does nothing, which is what startSpan returns when tracing is
+// disabled.
+type span struct {
+	s *trace.Span
+}
+
+// startSpan starts a child span of c named name, annotated with a hash of the
+// session key, if enabled is true. It returns the context to use for the
+// operation.
+func startSpan(c context.Context, enabled bool, name, key string) (context.Context, *span) {
+	if !enabled {
+		return c, nil
+	}
+	c, s := trace.StartSpan(c, "gaesessions/"+name)
+	s.AddAttributes(
+		trace.StringAttribute("gaesessions.operation", name),
+		trace.StringAttribute("gaesessions.key_hash", keyHash(key)),
+	)
+	return c, &span{s}
+}
+
+// keyHash returns the first 8 bytes of the SHA-256 hash of a session key in
+// hex. Spans are exported to tracing backends readable by more people than
+// the session store, so they must not carry the key itself, which lets
+// whoever holds it take over the session; the hash still ties together the
+// spans of one session.
+func keyHash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// end ends the span, recording err if it is non-nil.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.s.SetStatus(trace.Status{Code: trace.StatusCodeUnknown, Message: err.Error()})
+	}
+	s.s.End()
+}
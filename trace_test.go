@@ -0,0 +1,24 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestKeyHash(t *testing.T) {
+	id := "M5WGMLTGOJSWK3DBNZTWK5LSMVSGC4TF"
+	h := keyHash(id)
+	if len(h) != 16 || strings.Contains(h, id) || strings.Contains(id, h) {
+		t.Fatalf("keyHash(%q) = %q, want 16 hex digits unrelated to the key", id, h)
+	}
+	if keyHash(id) != h {
+		t.Fatal("keyHash is not deterministic")
+	}
+	if keyHash(id+"x") == h {
+		t.Fatal("keyHash of different keys collided")
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Transforms -----------------------------------------------------------------
+
+// A stored blob is a format-tagged serialized blob, possibly wrapped in any
+// number of envelopes. Every envelope starts with a tag byte of 0x80 or
+// above, which cannot be a serializer format, so a blob is loaded by
+// unwrapping envelopes according to their tags until a serialized blob is
+// left. The package defines two envelopes:
+//
+//	formatCompressed | algorithm (1 byte) | dictionary ID (4 bytes, big endian) | payload
+//	formatEncrypted | key ID (4 bytes, big endian) | nonce (12 bytes) | ciphertext
+//
+// formatCompressed is 0x80 and formatEncrypted is 0x81; see compress.go for
+// the compressed envelope. The encrypted envelope holds the AES-GCM
+// encryption of the inner blob, with the tag, key ID and session ID as
+// additional authenticated data, so that a blob cannot be moved to another
+// session. The key ID is the first four bytes of the SHA-256 hash of the key.
+const (
+	formatEncrypted byte = 0x81
+
+	encryptedHeaderLen = 5
+)
+
+// Transform wraps stored blobs in an envelope, e.g. to encrypt them. A store
+// applies its Transforms in order after serializing and compressing session
+// values, so the last one produces the outermost envelope. The ID of the
+// session a blob belongs to is passed as id, and is empty for sessions
+// stored in the cookie; a transform that authenticates blobs should bind
+// them to it.
+type Transform interface {
+	// Tag returns the first byte of every envelope the transform produces.
+	// Tags below 0x80 are reserved for serializer formats, 0x80 and 0x81
+	// for the envelopes defined by the package, and 0xff for the header of
+	// memcache items.
+	Tag() byte
+	// Wrap returns src in an envelope starting with Tag.
+	Wrap(src []byte, id string) ([]byte, error)
+	// Unwrap returns the blob inside an envelope produced by Wrap for the
+	// same id.
+	Unwrap(src []byte, id string) ([]byte, error)
+}
+
+var (
+	transformsMu sync.RWMutex
+	transforms   = map[byte]Transform{}
+)
+
+// RegisterTransform makes a transform available for loading blobs wrapped
+// with its tag. A store can always load blobs wrapped by its own Transforms;
+// registering is only needed to read blobs wrapped by a transform the store
+// no longer uses. It panics if the tag is reserved, see Transform, or if a
+// transform with the same tag is already registered.
+func RegisterTransform(t Transform) {
+	tag := t.Tag()
+	if err := checkTransformTag(tag); err != nil {
+		panic(err)
+	}
+	transformsMu.Lock()
+	defer transformsMu.Unlock()
+	if _, dup := transforms[tag]; dup {
+		panic(fmt.Sprintf("gaesessions: RegisterTransform called twice for tag 0x%02x", tag))
+	}
+	transforms[tag] = t
+}
+
+// checkTransformTag returns an error if a transform cannot use tag, because
+// it would be read as a serialized blob, a compressed envelope or a memcache
+// header. The encrypted envelope's tag is allowed, as AESGCMTransform uses
+// it.
+func checkTransformTag(tag byte) error {
+	switch {
+	case tag < formatCompressed:
+		return fmt.Errorf("gaesessions: transform tag 0x%02x is reserved for serializer formats", tag)
+	case tag == formatCompressed:
+		return fmt.Errorf("gaesessions: transform tag 0x%02x is reserved for compressed blobs", tag)
+	case tag == formatCreated:
+		return fmt.Errorf("gaesessions: transform tag 0x%02x is reserved for memcache items", tag)
+	}
+	return nil
+}
+
+// checkTransforms returns an error if a tag of ts is reserved or used by
+// more than one of them, so that their envelopes could not be told apart.
+func checkTransforms(ts []Transform) error {
+	for i, t := range ts {
+		if err := checkTransformTag(t.Tag()); err != nil {
+			return err
+		}
+		for _, other := range ts[:i] {
+			if other.Tag() == t.Tag() {
+				return fmt.Errorf("gaesessions: two transforms use tag 0x%02x", t.Tag())
+			}
+		}
+	}
+	return nil
+}
+
+// unwrap returns the blob inside the envelope src, using the first of ts
+// with a matching tag, and a registered transform otherwise.
+func unwrap(ts []Transform, src []byte, id string) ([]byte, error) {
+	var t Transform
+	for _, c := range ts {
+		if c.Tag() == src[0] {
+			t = c
+			break
+		}
+	}
+	if t == nil {
+		transformsMu.RLock()
+		t = transforms[src[0]]
+		transformsMu.RUnlock()
+	}
+	if t == nil {
+		return nil, fmt.Errorf("gaesessions: unknown envelope 0x%02x", src[0])
+	}
+	return t.Unwrap(src, id)
+}
+
+// AESGCMTransform encrypts and authenticates stored blobs with AES-GCM, so
+// that session values are unreadable and tamper-evident in the backing
+// store.
+type AESGCMTransform struct {
+	keyID uint32
+	aeads map[uint32]cipher.AEAD
+	// Rand is the source of nonces. If nil, crypto/rand is used.
+	Rand io.Reader
+}
+
+// NewAESGCMTransform returns an AESGCMTransform. key, which must be 16, 24
+// or 32 bytes long, encrypts new blobs; oldKeys are only used to decrypt
+// blobs encrypted with them, which allows keys to be rotated.
+func NewAESGCMTransform(key []byte, oldKeys ...[]byte) (*AESGCMTransform, error) {
+	t := &AESGCMTransform{aeads: make(map[uint32]cipher.AEAD)}
+	for i, k := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(k)
+		id := binary.BigEndian.Uint32(sum[:])
+		if i == 0 {
+			t.keyID = id
+		}
+		t.aeads[id] = aead
+	}
+	return t, nil
+}
+
+// Tag returns the tag of the encrypted envelope.
+func (t *AESGCMTransform) Tag() byte { return formatEncrypted }
+
+// Wrap encrypts src with the current key.
+func (t *AESGCMTransform) Wrap(src []byte, id string) ([]byte, error) {
+	aead := t.aeads[t.keyID]
+	rand := t.Rand
+	if rand == nil {
+		rand = cryptorand.Reader
+	}
+	dst := make([]byte, encryptedHeaderLen+aead.NonceSize(),
+		encryptedHeaderLen+aead.NonceSize()+len(src)+aead.Overhead())
+	dst[0] = formatEncrypted
+	binary.BigEndian.PutUint32(dst[1:], t.keyID)
+	nonce := dst[encryptedHeaderLen:]
+	if _, err := io.ReadFull(rand, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(dst, nonce, src, encryptedAAD(dst, id)), nil
+}
+
+// Unwrap decrypts src and checks its integrity.
+func (t *AESGCMTransform) Unwrap(src []byte, id string) ([]byte, error) {
+	if len(src) < encryptedHeaderLen {
+		return nil, errors.New("gaesessions: truncated encrypted blob")
+	}
+	keyID := binary.BigEndian.Uint32(src[1:])
+	aead, ok := t.aeads[keyID]
+	if !ok {
+		return nil, fmt.Errorf("gaesessions: unknown encryption key %08x", keyID)
+	}
+	if len(src) < encryptedHeaderLen+aead.NonceSize() {
+		return nil, errors.New("gaesessions: truncated encrypted blob")
+	}
+	nonce := src[encryptedHeaderLen : encryptedHeaderLen+aead.NonceSize()]
+	return aead.Open(nil, nonce, src[encryptedHeaderLen+aead.NonceSize():], encryptedAAD(src, id))
+}
+
+// encryptedAAD returns the additional authenticated data of the encrypted
+// envelope b of the session with the given ID: its header followed by id.
+func encryptedAAD(b []byte, id string) []byte {
+	aad := make([]byte, 0, encryptedHeaderLen+len(id))
+	aad = append(aad, b[:encryptedHeaderLen]...)
+	return append(aad, id...)
+}
@@ -0,0 +1,72 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"testing"
+)
+
+// tagTransform wraps blobs in an envelope holding nothing but its tag.
+type tagTransform byte
+
+func (t tagTransform) Tag() byte { return byte(t) }
+
+func (t tagTransform) Wrap(src []byte, id string) ([]byte, error) {
+	return append([]byte{byte(t)}, src...), nil
+}
+
+func (t tagTransform) Unwrap(src []byte, id string) ([]byte, error) {
+	return src[1:], nil
+}
+
+// panics reports whether f panics.
+func panics(f func()) (panicked bool) {
+	defer func() { panicked = recover() != nil }()
+	f()
+	return false
+}
+
+func TestRegisterTransformTags(t *testing.T) {
+	for _, tag := range []byte{FormatGob, 0x7f, formatCompressed, formatCreated} {
+		if !panics(func() { RegisterTransform(tagTransform(tag)) }) {
+			t.Errorf("RegisterTransform accepted the reserved tag 0x%02x", tag)
+		}
+	}
+	t.Cleanup(func() {
+		transformsMu.Lock()
+		delete(transforms, 0x9a)
+		transformsMu.Unlock()
+	})
+	if panics(func() { RegisterTransform(tagTransform(0x9a)) }) {
+		t.Fatal("RegisterTransform rejected tag 0x9a")
+	}
+	if !panics(func() { RegisterTransform(tagTransform(0x9a)) }) {
+		t.Error("RegisterTransform replaced the transform registered for tag 0x9a")
+	}
+}
+
+func TestStoreTransformTags(t *testing.T) {
+	values := map[interface{}]interface{}{"user": "gopher"}
+	for _, ts := range [][]Transform{
+		{tagTransform(0x7f)},
+		{tagTransform(formatCreated)},
+		{tagTransform(0x9b), tagTransform(0x9b)},
+	} {
+		enc := blobEncoding{serializer: GobSerializer{}, transforms: ts}
+		if _, err := enc.encode("id", values); err == nil {
+			t.Errorf("encode with transform tags %v succeeded", ts)
+		}
+	}
+
+	enc := blobEncoding{serializer: GobSerializer{}, transforms: []Transform{tagTransform(0x9b), tagTransform(0x9c)}}
+	blob, err := enc.encode("id", values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[interface{}]interface{}
+	if err := enc.decode("id", blob, &got); err != nil || got["user"] != "gopher" {
+		t.Fatalf("decode returned %v, error %v", got, err)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gaesessions
+
+import (
+	"encoding/gob"
+	"math"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+// Values ---------------------------------------------------------------------
+
+func init() {
+	// time.Time is not registered with gob by default, so sessions holding
+	// one could not be saved with GobSerializer.
+	gob.Register(time.Time{})
+}
+
+// Values wraps a session with typed accessors for its values:
+//
+//	v := gaesessions.Values{session}
+//	v.SetInt64("visits", visits+1)
+//	name, ok := v.GetString("name")
+//
+// The getters report false if the key is missing or holds another type.
+// Numbers are converted between int, int64 and float64 where no precision is
+// lost, since JSONSerializer loads every number as a float64.
+type Values struct {
+	*sessions.Session
+}
+
+// GetString returns the string stored under key.
+func (v Values) GetString(key interface{}) (string, bool) {
+	s, ok := v.Session.Values[key].(string)
+	return s, ok
+}
+
+// SetString stores s under key.
+func (v Values) SetString(key interface{}, s string) {
+	v.Session.Values[key] = s
+}
+
+// GetBool returns the bool stored under key.
+func (v Values) GetBool(key interface{}) (bool, bool) {
+	b, ok := v.Session.Values[key].(bool)
+	return b, ok
+}
+
+// SetBool stores b under key.
+func (v Values) SetBool(key interface{}, b bool) {
+	v.Session.Values[key] = b
+}
+
+// GetInt returns the integer stored under key.
+func (v Values) GetInt(key interface{}) (int, bool) {
+	n, ok := v.GetInt64(key)
+	if !ok || int64(int(n)) != n {
+		return 0, false
+	}
+	return int(n), true
+}
+
+// SetInt stores n under key.
+func (v Values) SetInt(key interface{}, n int) {
+	v.Session.Values[key] = n
+}
+
+// GetInt64 returns the integer stored under key.
+func (v Values) GetInt64(key interface{}) (int64, bool) {
+	switch n := v.Session.Values[key].(type) {
+	case int64:
+		return n, true
+	case int:
+		return int64(n), true
+	case float64:
+		if n == math.Trunc(n) && n >= math.MinInt64 && n < math.MaxInt64 {
+			return int64(n), true
+		}
+	}
+	return 0, false
+}
+
+// SetInt64 stores n under key.
+func (v Values) SetInt64(key interface{}, n int64) {
+	v.Session.Values[key] = n
+}
+
+// GetFloat64 returns the number stored under key.
+func (v Values) GetFloat64(key interface{}) (float64, bool) {
+	switch n := v.Session.Values[key].(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// SetFloat64 stores f under key.
+func (v Values) SetFloat64(key interface{}, f float64) {
+	v.Session.Values[key] = f
+}
+
+// GetTime returns the time stored under key. JSONSerializer loads times back
+// as strings, which GetTime does not accept; with it, store t.Unix() with
+// SetInt64 instead.
+func (v Values) GetTime(key interface{}) (time.Time, bool) {
+	t, ok := v.Session.Values[key].(time.Time)
+	return t, ok
+}
+
+// SetTime stores t under key.
+func (v Values) SetTime(key interface{}, t time.Time) {
+	v.Session.Values[key] = t
+}
+
+// Delete removes the value stored under key.
+func (v Values) Delete(key interface{}) {
+	delete(v.Session.Values, key)
+}